@@ -1,21 +1,91 @@
 package main
 
+import "sort"
+
 type Chunk struct {
 	Code      []byte
 	P         int
-	Lines     []int
+	Lines     LineTable
 	Constants []Value
+	Handlers  []Handler
+}
+
+// Handler is an entry in a chunk's exception table. An exception thrown
+// by the code from Start up to End lands at Target, with the frame's stack
+// cut back to Depth slots and the exception pushed on top. Handlers of
+// nested try statements come before those of the statements around them.
+type Handler struct {
+	Start  int
+	End    int
+	Target int
+	Depth  int
+}
+
+// LineTable maps bytecode offsets back to source positions. Consecutive
+// bytes emitted for the same token share a single run, so a chunk stores
+// one entry per token rather than one per byte.
+type LineTable struct {
+	runs  []lineRun
+	count int
+}
+
+type lineRun struct {
+	start  int // first offset the run covers
+	line   int
+	column int
+}
+
+func (table *LineTable) add(line int, column int) {
+	if n := len(table.runs); n > 0 && table.runs[n-1].line == line && table.runs[n-1].column == column {
+		table.count++
+		return
+	}
+	table.runs = append(table.runs, lineRun{start: table.count, line: line, column: column})
+	table.count++
+}
+
+func (table *LineTable) find(offset int) *lineRun {
+	if offset < 0 || offset >= table.count {
+		return nil
+	}
+	i := sort.Search(len(table.runs), func(i int) bool {
+		return table.runs[i].start > offset
+	})
+	return &table.runs[i-1]
+}
+
+// line returns the source line for offset, or -1 if it is out of range.
+func (table *LineTable) line(offset int) int {
+	if run := table.find(offset); run != nil {
+		return run.line
+	}
+	return -1
+}
+
+func (table *LineTable) column(offset int) int {
+	if run := table.find(offset); run != nil {
+		return run.column
+	}
+	return -1
 }
 
 func (chunk *Chunk) InitChunk() {
 	chunk.Code = []byte{}
-	chunk.Lines = []int{}
+	chunk.Lines = LineTable{}
 	chunk.Constants = []Value{}
 }
 
-func (chunk *Chunk) WriteChunk(b byte, line int) {
+func (chunk *Chunk) WriteChunk(b byte, line int, column int) {
 	chunk.Code = append(chunk.Code, b)
-	chunk.Lines = append(chunk.Lines, line)
+	chunk.Lines.add(line, column)
+}
+
+func (chunk *Chunk) GetLine(offset int) int {
+	return chunk.Lines.line(offset)
+}
+
+func (chunk *Chunk) GetColumn(offset int) int {
+	return chunk.Lines.column(offset)
 }
 
 func (chunk *Chunk) AddConstant(value Value) int {
@@ -0,0 +1,10 @@
+//go:build regvm
+
+package main
+
+// execute runs the compiled script on the register machine, translating
+// each function to register code as it is first called.
+func (vm *VM) execute() InterpretResult {
+	// vm.frame().Closure.Function.registers().DisassembleRegChunk("code") // comment
+	return vm.runRegisters()
+}
@@ -0,0 +1,9 @@
+//go:build !regvm
+
+package main
+
+// execute runs the compiled chunk on the stack machine. Build with
+// `-tags regvm` to use the register backend instead.
+func (vm *VM) execute() InterpretResult {
+	return vm.run()
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// NativeMethod implements a method on one of the built-in object types.
+// It reports failures through vm.runtimeError and returns false.
+type NativeMethod struct {
+	MinArity int
+	MaxArity int
+	Fn       func(vm *VM, receiver Value, args []Value) (Value, bool)
+}
+
+var listMethods = map[string]NativeMethod{
+	"push":     {1, 1, listPush},
+	"pop":      {0, 0, listPop},
+	"insert":   {2, 2, listInsert},
+	"remove":   {1, 1, listRemove},
+	"len":      {0, 0, listLen},
+	"slice":    {1, 2, listSlice},
+	"contains": {1, 1, listContains},
+}
+
+var errorMethods = map[string]NativeMethod{
+	"message": {0, 0, errorMessage},
+	"trace":   {0, 0, errorTrace},
+}
+
+// generatorMethods leaves out next(), which the VM handles itself as it
+// resumes the generator in a new frame.
+var generatorMethods = map[string]NativeMethod{
+	"done": {0, 0, generatorDone},
+}
+
+// fiberMethods leaves out call(), try() and transfer(), which the VM
+// handles itself as they switch fibers.
+var fiberMethods = map[string]NativeMethod{
+	"isDone": {0, 0, fiberIsDone},
+	"error":  {0, 0, fiberError},
+}
+
+var channelMethods = map[string]NativeMethod{
+	"send":     {1, 1, channelSend},
+	"receive":  {0, 0, channelReceive},
+	"close":    {0, 0, channelClose},
+	"isClosed": {0, 0, channelIsClosed},
+}
+
+var threadMethods = map[string]NativeMethod{
+	"join":   {0, 0, threadJoin},
+	"isDone": {0, 0, threadIsDone},
+}
+
+var mapMethods = map[string]NativeMethod{
+	"has":    {1, 1, mapHas},
+	"remove": {1, 1, mapRemove},
+	"keys":   {0, 0, mapKeys},
+	"values": {0, 0, mapValues},
+	"len":    {0, 0, mapLen},
+}
+
+// natives are the functions every module starts with as globals.
+var natives = []*ObjNative{
+	newNative("clock", 0, clockNative),
+	newNative("error", 1, errorNative),
+	newNative("range", 2, rangeNative),
+	newNative("Channel", 1, channelNative),
+	newNative("select", 1, selectNative),
+}
+
+// channelNative makes a channel that holds up to its argument's number of
+// values that have been sent but not received. With none, a send waits for
+// a receiver.
+func channelNative(vm *VM, args []Value) (Value, bool) {
+	if !IsNumber(args[0]) || AsNumber(args[0]) < 0 || AsNumber(args[0]) != math.Floor(AsNumber(args[0])) {
+		vm.runtimeError("Channel capacity must be a non-negative integer.")
+		return NilVal(), false
+	}
+	return ObjVal(newChannel(int(AsNumber(args[0])))), true
+}
+
+// selectNative waits to receive from whichever of a list of channels has a
+// value first, and returns that channel and the value as a list. A closed
+// channel gives nil at once.
+func selectNative(vm *VM, args []Value) (Value, bool) {
+	if !IsObjType(args[0], OBJ_LIST) || len(AsList(args[0]).Items) == 0 {
+		vm.runtimeError("Can only select over a list of channels.")
+		return NilVal(), false
+	}
+	items := AsList(args[0]).Items
+	channels := make([]*ObjChannel, len(items))
+	for i, item := range items {
+		if !IsObjType(item, OBJ_CHANNEL) {
+			vm.runtimeError("Can only select over a list of channels.")
+			return NilVal(), false
+		}
+		channels[i] = AsChannel(item)
+	}
+
+	chosen, value, ok := vm.selectChannels(channels)
+	if !ok {
+		return NilVal(), false
+	}
+	return ObjVal(newList([]Value{items[chosen], value})), true
+}
+
+// fiberModule is the global Fiber, whose functions make fibers and
+// switch away from the running one.
+var fiberModule = newNativeModule("Fiber",
+	newNative("new", 1, fiberNew),
+	newNative("yield", 1, fiberYield),
+	newNative("current", 0, fiberCurrent),
+)
+
+func defineNatives(globals map[string]Value) {
+	for _, native := range natives {
+		globals[native.Name] = ObjVal(native)
+	}
+	globals[fiberModule.Name] = ObjVal(fiberModule)
+}
+
+// newNativeModule makes a module exporting each of functions.
+func newNativeModule(name string, functions ...*ObjNative) *ObjModule {
+	module := &ObjModule{
+		Obj:       Obj{Type: OBJ_MODULE},
+		Name:      name,
+		Globals:   make(map[string]Value),
+		Exports:   make(map[string]bool),
+		Constants: make(map[string]bool),
+		Loaded:    true,
+	}
+	for _, function := range functions {
+		module.Globals[function.Name] = ObjVal(function)
+		module.Exports[function.Name] = true
+	}
+	return module
+}
+
+// fiberNew makes a fiber that will run its argument, a function taking at
+// most one parameter, the first time it is switched to.
+func fiberNew(vm *VM, args []Value) (Value, bool) {
+	if !IsObjType(args[0], OBJ_CLOSURE) {
+		vm.runtimeError("Can only make a fiber from a function.")
+		return NilVal(), false
+	}
+	closure := AsClosure(args[0])
+	if closure.Function.Generator {
+		vm.runtimeError("Can't make a fiber from a generator.")
+		return NilVal(), false
+	}
+	if closure.Function.Arity > 1 {
+		vm.runtimeError("Fiber function must take at most one parameter.")
+		return NilVal(), false
+	}
+	return ObjVal(newFiber(closure)), true
+}
+
+// fiberYield suspends the running fiber, going back to the one that called
+// it with its argument.
+func fiberYield(vm *VM, args []Value) (Value, bool) {
+	fiber := vm.Running
+	if fiber.Caller == nil {
+		vm.runtimeError("Can't yield from a fiber with no caller.")
+		return NilVal(), false
+	}
+	vm.Switch = fiber.Caller
+	fiber.Caller = nil
+	fiber.State = FIBER_SUSPENDED
+	return args[0], true
+}
+
+func fiberCurrent(vm *VM, args []Value) (Value, bool) {
+	return ObjVal(vm.Running), true
+}
+
+// clockNative returns the seconds elapsed since the program started.
+func clockNative(vm *VM, args []Value) (Value, bool) {
+	return NumberVal(time.Since(startTime).Seconds()), true
+}
+
+var startTime = time.Now()
+
+// errorNative makes an error object like the ones runtime errors throw,
+// with the trace of where it was made.
+func errorNative(vm *VM, args []Value) (Value, bool) {
+	return ObjVal(newError(toString(args[0]), vm.stackTrace())), true
+}
+
+func (vm *VM) invoke(name string, receiver Value, args []Value) (Value, bool) {
+	var methods map[string]NativeMethod
+	switch {
+	case IsObjType(receiver, OBJ_LIST):
+		methods = listMethods
+	case IsObjType(receiver, OBJ_MAP):
+		methods = mapMethods
+	case IsObjType(receiver, OBJ_ERROR):
+		methods = errorMethods
+	case IsObjType(receiver, OBJ_GENERATOR):
+		methods = generatorMethods
+	case IsObjType(receiver, OBJ_FIBER):
+		methods = fiberMethods
+	case IsObjType(receiver, OBJ_CHANNEL):
+		methods = channelMethods
+	case IsObjType(receiver, OBJ_THREAD):
+		methods = threadMethods
+	default:
+		vm.runtimeError("Only instances have methods.")
+		return NilVal(), false
+	}
+
+	method, ok := methods[name]
+	if !ok {
+		vm.runtimeError("Undefined property '%s'.", name)
+		return NilVal(), false
+	}
+	if len(args) < method.MinArity || len(args) > method.MaxArity {
+		if method.MinArity == method.MaxArity {
+			vm.runtimeError("Expected %d arguments but got %d.", method.MinArity, len(args))
+		} else {
+			vm.runtimeError("Expected %d to %d arguments but got %d.", method.MinArity, method.MaxArity, len(args))
+		}
+		return NilVal(), false
+	}
+	return method.Fn(vm, receiver, args)
+}
+
+// rangeNative makes the range from its first argument up to its second.
+func rangeNative(vm *VM, args []Value) (Value, bool) {
+	if !IsNumber(args[0]) || !IsNumber(args[1]) {
+		vm.runtimeError("Range bounds must be numbers.")
+		return NilVal(), false
+	}
+	return ObjVal(newRange(AsNumber(args[0]), AsNumber(args[1]))), true
+}
+
+// nextItem steps a for-in loop over iterable, whose position in it is kept
+// in *position, starting from 0. more is false once there are no items
+// left.
+func (vm *VM) nextItem(iterable Value, position *Value) (item Value, more bool, ok bool) {
+	i := int(AsNumber(*position))
+	switch {
+	case IsObjType(iterable, OBJ_LIST):
+		items := AsList(iterable).Items
+		if i >= len(items) {
+			return NilVal(), false, true
+		}
+		item = items[i]
+		i++
+	case IsObjType(iterable, OBJ_MAP):
+		// The position is in the map's entries, skipping tombstones.
+		entries := AsMap(iterable).entries
+		for i < len(entries) && entries[i].removed {
+			i++
+		}
+		if i >= len(entries) {
+			return NilVal(), false, true
+		}
+		item = entries[i].key
+		i++
+	case IsObjType(iterable, OBJ_RANGE):
+		r := AsRange(iterable)
+		if r.Start+float64(i) >= r.End {
+			return NilVal(), false, true
+		}
+		item = NumberVal(r.Start + float64(i))
+		i++
+	case IsString(iterable):
+		// Strings are stepped through a character at a time, and i is a
+		// byte offset.
+		str := AsString(iterable)
+		if i >= len(str) {
+			return NilVal(), false, true
+		}
+		char, size := utf8.DecodeRuneInString(str[i:])
+		item = StringVal(string(char))
+		i += size
+	case IsObjType(iterable, OBJ_CHANNEL):
+		// A channel gives what is sent on it until it is closed.
+		return vm.receive(AsChannel(iterable))
+	default:
+		vm.runtimeError("Can only iterate over lists, maps, strings, ranges, generators and channels.")
+		return NilVal(), false, false
+	}
+	*position = NumberVal(float64(i))
+	return item, true, true
+}
+
+// getProperty reads a name a module exports.
+func (vm *VM) getProperty(object Value, name string) (Value, bool) {
+	if !IsObjType(object, OBJ_MODULE) {
+		vm.runtimeError("Only modules have properties.")
+		return NilVal(), false
+	}
+	module := AsModule(object)
+	value, ok := module.Globals[name]
+	if !ok || !module.Exports[name] {
+		vm.runtimeError("Module '%s' does not export '%s'.", module.Name, name)
+		return NilVal(), false
+	}
+	return value, true
+}
+
+func (vm *VM) getIndex(container Value, index Value) (Value, bool) {
+	if IsObjType(container, OBJ_MAP) {
+		key, ok := vm.mapKey(index)
+		if !ok {
+			return NilVal(), false
+		}
+		value, found := AsMap(container).get(key)
+		if !found {
+			vm.runtimeError("Key not found in map.")
+			return NilVal(), false
+		}
+		return value, true
+	}
+	if !IsObjType(container, OBJ_LIST) {
+		vm.runtimeError("Only lists and maps can be indexed.")
+		return NilVal(), false
+	}
+	list := AsList(container)
+	i, ok := vm.listIndex(list, index, len(list.Items))
+	if !ok {
+		return NilVal(), false
+	}
+	return list.Items[i], true
+}
+
+func (vm *VM) setIndex(container Value, index Value, value Value) bool {
+	if IsObjType(container, OBJ_MAP) {
+		key, ok := vm.mapKey(index)
+		if !ok {
+			return false
+		}
+		AsMap(container).set(key, index, value)
+		return true
+	}
+	if !IsObjType(container, OBJ_LIST) {
+		vm.runtimeError("Only lists and maps can be indexed.")
+		return false
+	}
+	list := AsList(container)
+	i, ok := vm.listIndex(list, index, len(list.Items))
+	if !ok {
+		return false
+	}
+	list.Items[i] = value
+	return true
+}
+
+// listIndex resolves a possibly negative index against a list, counting
+// from the end when negative. Indexes equal to limit are out of bounds, so
+// insert passes len+1 to allow appending.
+func (vm *VM) listIndex(list *ObjList, index Value, limit int) (int, bool) {
+	if !IsNumber(index) || AsNumber(index) != math.Trunc(AsNumber(index)) {
+		vm.runtimeError("List index must be an integer.")
+		return 0, false
+	}
+	i := int(AsNumber(index))
+	if i < 0 {
+		i += len(list.Items)
+	}
+	if i < 0 || i >= limit {
+		vm.runtimeError("List index out of bounds.")
+		return 0, false
+	}
+	return i, true
+}
+
+func listPush(vm *VM, receiver Value, args []Value) (Value, bool) {
+	list := AsList(receiver)
+	list.Items = append(list.Items, args[0])
+	return NilVal(), true
+}
+
+func listPop(vm *VM, receiver Value, args []Value) (Value, bool) {
+	list := AsList(receiver)
+	if len(list.Items) == 0 {
+		vm.runtimeError("Can't pop from an empty list.")
+		return NilVal(), false
+	}
+	value := list.Items[len(list.Items)-1]
+	list.Items = list.Items[:len(list.Items)-1]
+	return value, true
+}
+
+func listInsert(vm *VM, receiver Value, args []Value) (Value, bool) {
+	list := AsList(receiver)
+	i, ok := vm.listIndex(list, args[0], len(list.Items)+1)
+	if !ok {
+		return NilVal(), false
+	}
+	list.Items = append(list.Items, NilVal())
+	copy(list.Items[i+1:], list.Items[i:])
+	list.Items[i] = args[1]
+	return NilVal(), true
+}
+
+// listRemove deletes the element at an index and returns it.
+func listRemove(vm *VM, receiver Value, args []Value) (Value, bool) {
+	list := AsList(receiver)
+	i, ok := vm.listIndex(list, args[0], len(list.Items))
+	if !ok {
+		return NilVal(), false
+	}
+	value := list.Items[i]
+	list.Items = append(list.Items[:i], list.Items[i+1:]...)
+	return value, true
+}
+
+func listLen(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return NumberVal(float64(len(AsList(receiver).Items))), true
+}
+
+// listSlice copies the elements from start up to, but not including, end.
+// Both bounds may be negative and are clamped to the list like Python's.
+func listSlice(vm *VM, receiver Value, args []Value) (Value, bool) {
+	list := AsList(receiver)
+	bounds := []int{0, len(list.Items)}
+	for i, arg := range args {
+		if !IsNumber(arg) || AsNumber(arg) != math.Trunc(AsNumber(arg)) {
+			vm.runtimeError("Slice bounds must be integers.")
+			return NilVal(), false
+		}
+		bound := int(AsNumber(arg))
+		if bound < 0 {
+			bound += len(list.Items)
+		}
+		bounds[i] = min(max(bound, 0), len(list.Items))
+	}
+	start, end := bounds[0], max(bounds[0], bounds[1])
+	return ObjVal(newList(append([]Value{}, list.Items[start:end]...))), true
+}
+
+func listContains(vm *VM, receiver Value, args []Value) (Value, bool) {
+	for _, item := range AsList(receiver).Items {
+		if valuesEqual(item, args[0]) {
+			return BoolVal(true), true
+		}
+	}
+	return BoolVal(false), true
+}
+
+// buildMap makes a map from alternating keys and values.
+func (vm *VM) buildMap(entries []Value) (Value, bool) {
+	m := newMap()
+	for i := 0; i < len(entries); i += 2 {
+		key, ok := vm.mapKey(entries[i])
+		if !ok {
+			return NilVal(), false
+		}
+		m.set(key, entries[i], entries[i+1])
+	}
+	return ObjVal(m), true
+}
+
+func (vm *VM) mapKey(key Value) (HashKey, bool) {
+	hash, ok := hashKey(key)
+	if !ok {
+		vm.runtimeError("Map keys must be strings, numbers, booleans or nil.")
+	}
+	return hash, ok
+}
+
+func mapHas(vm *VM, receiver Value, args []Value) (Value, bool) {
+	key, ok := vm.mapKey(args[0])
+	if !ok {
+		return NilVal(), false
+	}
+	_, found := AsMap(receiver).get(key)
+	return BoolVal(found), true
+}
+
+// mapRemove deletes a key and returns its value, or nil if it was absent.
+func mapRemove(vm *VM, receiver Value, args []Value) (Value, bool) {
+	key, ok := vm.mapKey(args[0])
+	if !ok {
+		return NilVal(), false
+	}
+	value, _ := AsMap(receiver).remove(key)
+	return value, true
+}
+
+func mapKeys(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return ObjVal(newList(AsMap(receiver).keys())), true
+}
+
+func mapValues(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return ObjVal(newList(AsMap(receiver).values())), true
+}
+
+func mapLen(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return NumberVal(float64(AsMap(receiver).len())), true
+}
+
+func errorMessage(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return StringVal(AsError(receiver).Message), true
+}
+
+// errorTrace lists the lines of the error's stack trace, innermost call
+// first.
+func errorTrace(vm *VM, receiver Value, args []Value) (Value, bool) {
+	var lines []Value
+	for _, line := range AsError(receiver).Trace {
+		lines = append(lines, StringVal(line))
+	}
+	return ObjVal(newList(lines)), true
+}
+
+func generatorDone(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return BoolVal(AsGenerator(receiver).State == GENERATOR_DONE), true
+}
+
+func fiberIsDone(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return BoolVal(AsFiber(receiver).State == FIBER_DONE), true
+}
+
+// fiberError is what killed the fiber, or nil if nothing has.
+func fiberError(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return AsFiber(receiver).Error, true
+}
+
+// channelSend waits until the channel has room for the value, or a
+// receiver takes it.
+func channelSend(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return NilVal(), vm.send(AsChannel(receiver), args[0])
+}
+
+// channelReceive returns nil once the channel is closed and empty.
+func channelReceive(vm *VM, receiver Value, args []Value) (Value, bool) {
+	value, _, ok := vm.receive(AsChannel(receiver))
+	return value, ok
+}
+
+func channelClose(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return NilVal(), vm.closeChannel(AsChannel(receiver))
+}
+
+func channelIsClosed(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return BoolVal(AsChannel(receiver).Closed), true
+}
+
+// threadJoin waits for the thread to finish and returns what its function
+// returned, or nil if it died of an exception.
+func threadJoin(vm *VM, receiver Value, args []Value) (Value, bool) {
+	thread := AsThread(receiver)
+	if !vm.join(thread) {
+		return NilVal(), false
+	}
+	return thread.Result, true
+}
+
+func threadIsDone(vm *VM, receiver Value, args []Value) (Value, bool) {
+	return BoolVal(AsThread(receiver).Done), true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type position struct {
+	line   int
+	column int
+}
+
+// TestLineTableOnCorpus compiles every script in test/ and checks the
+// line table of each chunk it makes: every offset has a position inside
+// the script, GetLine and GetColumn agree with a plain scan of the runs,
+// and writing the same positions into a new chunk gives the same table.
+func TestLineTableOnCorpus(t *testing.T) {
+	// Scripts that test compile errors report them on stderr.
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stderr := os.Stderr
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+
+	scripts := 0
+	err = filepath.WalkDir("test", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, ".lox") {
+			return err
+		}
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		scripts++
+		function := Compile(string(source), newModule(filepath.Base(path), path))
+		if function == nil {
+			return nil
+		}
+		lines := strings.Split(string(source), "\n")
+		for _, chunk := range chunksOf(function) {
+			checkLineTable(t, path, lines, chunk)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scripts == 0 {
+		t.Fatal("no scripts found in test/")
+	}
+}
+
+// chunksOf is the chunk of function and of every function compiled inside
+// it.
+func chunksOf(function *ObjFunction) []*Chunk {
+	chunks := []*Chunk{&function.Chunk}
+	for _, constant := range function.Chunk.Constants {
+		if IsObjType(constant, OBJ_FUNCTION) {
+			chunks = append(chunks, chunksOf(AsFunction(constant))...)
+		}
+	}
+	return chunks
+}
+
+func checkLineTable(t *testing.T, path string, lines []string, chunk *Chunk) {
+	t.Helper()
+	if chunk.Lines.count != len(chunk.Code) {
+		t.Errorf("%s: table covers %d bytes of %d", path, chunk.Lines.count, len(chunk.Code))
+		return
+	}
+
+	var rebuilt Chunk
+	rebuilt.InitChunk()
+	run := -1
+	for offset, b := range chunk.Code {
+		for run+1 < len(chunk.Lines.runs) && chunk.Lines.runs[run+1].start <= offset {
+			run++
+		}
+		want := chunk.Lines.runs[run]
+		line, column := chunk.GetLine(offset), chunk.GetColumn(offset)
+		if line != want.line || column != want.column {
+			t.Errorf("%s: offset %d is at %d:%d, want %d:%d", path, offset, line, column, want.line, want.column)
+			return
+		}
+		// The end of the script is one past its last line. A token such as
+		// a multi-line string has its last line but its first column, so
+		// the column is only checked to be on some line.
+		if line < 1 || line > len(lines)+1 || column < 1 {
+			t.Errorf("%s: offset %d is at %d:%d, outside the script", path, offset, line, column)
+			return
+		}
+		rebuilt.WriteChunk(b, line, column)
+	}
+	if !slices.Equal(rebuilt.Lines.runs, chunk.Lines.runs) {
+		t.Errorf("%s: rewriting the positions gives runs %v, want %v", path, rebuilt.Lines.runs, chunk.Lines.runs)
+	}
+}
+
+func TestLineTableLookups(t *testing.T) {
+	writes := []position{{1, 1}, {1, 1}, {1, 5}, {2, 1}, {2, 1}, {2, 1}, {4, 3}}
+	var table LineTable
+	for _, write := range writes {
+		table.add(write.line, write.column)
+	}
+	if len(table.runs) != 4 {
+		t.Errorf("got %d runs, want 4", len(table.runs))
+	}
+
+	for offset, want := range writes {
+		if line := table.line(offset); line != want.line {
+			t.Errorf("line(%d) = %d, want %d", offset, line, want.line)
+		}
+		if column := table.column(offset); column != want.column {
+			t.Errorf("column(%d) = %d, want %d", offset, column, want.column)
+		}
+	}
+
+	// The first and last offset of each run find that run.
+	for _, test := range []struct{ offset, start int }{
+		{0, 0}, {1, 0}, {2, 2}, {3, 3}, {5, 3}, {6, 6},
+	} {
+		if run := table.find(test.offset); run == nil || run.start != test.start {
+			t.Errorf("find(%d) = %v, want the run starting at %d", test.offset, run, test.start)
+		}
+	}
+
+	for _, offset := range []int{-1, len(writes)} {
+		if run := table.find(offset); run != nil {
+			t.Errorf("find(%d) = %v, want nil", offset, run)
+		}
+		if line := table.line(offset); line != -1 {
+			t.Errorf("line(%d) = %d, want -1", offset, line)
+		}
+		if column := table.column(offset); column != -1 {
+			t.Errorf("column(%d) = %d, want -1", offset, column)
+		}
+	}
+
+	var empty LineTable
+	if run := empty.find(0); run != nil {
+		t.Errorf("find(0) on an empty table = %v, want nil", run)
+	}
+}
@@ -3,9 +3,12 @@ package main
 // currentChunk = len(compilingChunk.Code)
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 type Parser struct {
@@ -13,19 +16,31 @@ type Parser struct {
 	previous  Token
 	panicMode bool
 	hadError  bool
+	// module is the module being compiled, whose globals the functions
+	// use and whose exports the declarations add to.
+	module *ObjModule
+	// constants are the globals declared const so far in this source.
+	// The module's Constants only gains them once they are defined.
+	constants map[string]bool
 }
 
 const (
-	PREC_NONE       = iota
-	PREC_ASSIGNMENT // =
-	PREC_OR         // or
-	PREC_AND        // and
-	PREC_EQUALITY   // == !=
-	PREC_COMPARISON // < > <= >=
-	PREC_TERM       // + -
-	PREC_FACTOR     // * /
-	PREC_UNARY      // ! -
-	PREC_CALL       // . ()
+	PREC_NONE        = iota
+	PREC_ASSIGNMENT  // =
+	PREC_CONDITIONAL // ?:
+	PREC_OR          // or
+	PREC_AND         // and
+	PREC_EQUALITY    // == !=
+	PREC_COMPARISON  // < > <= >=
+	PREC_BIT_OR      // |
+	PREC_BIT_XOR     // ^
+	PREC_BIT_AND     // &
+	PREC_SHIFT       // << >>
+	PREC_TERM        // + -
+	PREC_FACTOR      // * / ~/ %
+	PREC_UNARY       // ! -
+	PREC_EXPONENT    // **
+	PREC_CALL        // . ()
 	PREC_PRIMARY
 )
 
@@ -40,25 +55,94 @@ type ParseRule struct {
 }
 
 type Local struct {
-	name  Token
-	depth int
+	name       Token
+	depth      int
+	isCaptured bool
+	constant   bool
 }
 
+type Upvalue struct {
+	index    byte
+	isLocal  bool
+	constant bool
+}
+
+type FunctionType int
+
+const (
+	TYPE_FUNCTION FunctionType = iota
+	TYPE_SCRIPT
+)
+
 type Compiler struct {
-	locals     []Local
-	localCount int
+	enclosing    *Compiler
+	function     *ObjFunction
+	functionType FunctionType
+	locals       []Local
+	localCount   int
+	upvalues     []Upvalue
+	scopeDepth   int
+	loop         *Loop
+	try          *Try
+}
+
+// Loop tracks the innermost loop being compiled so that break and continue
+// know where to jump and which locals to discard on the way out. A switch
+// statement is one too, for break, but continue passes through it to the
+// loop around it.
+type Loop struct {
+	enclosing  *Loop
+	start      int
 	scopeDepth int
+	breakJumps []int
+	try        *Try // the innermost Try around the loop
+	isSwitch   bool
+}
+
+// Try tracks the innermost try statement with a finally clause, so that
+// break, continue and return leaving it run the finally block on the way.
+type Try struct {
+	enclosing  *Try
+	localCount int  // locals outside the try block, counting the two below
+	completion byte // slot saying which exit entered the finally block
+	value      byte // slot carrying an exception or return value past it
+	exits      []tryExit
+}
+
+// tryExit is one way out of a try statement through its finally block.
+// The jump sets completion to code and enters the block, and resume
+// carries on from wherever the exit was headed once the block has run.
+type tryExit struct {
+	code   int
+	jump   int
+	resume func()
 }
 
 var scanner *Scanner
-var compilingChunk *Chunk
 var current *Compiler
 
-func compiler_init() {
-	current = &Compiler{}
-	current.locals = make([]Local, 256)
-	current.localCount = 0
-	current.scopeDepth = 0
+func (parser *Parser) initCompiler(compiler *Compiler, functionType FunctionType) {
+	compiler.enclosing = current
+	compiler.function = newFunction()
+	compiler.function.Module = parser.module
+	compiler.functionType = functionType
+	compiler.locals = make([]Local, 256)
+	compiler.localCount = 0
+	compiler.scopeDepth = 0
+	current = compiler
+	if functionType != TYPE_SCRIPT && parser.previous.Type == TOKEN_IDENTIFIER {
+		current.function.Name = string(parser.previous.start)
+	}
+
+	// Slot zero holds the function being called.
+	local := &current.locals[current.localCount]
+	current.localCount++
+	local.depth = 0
+	local.name.start = []rune{}
+}
+
+func currentChunk() *Chunk {
+	return &current.function.Chunk
 }
 
 var rules []ParseRule
@@ -67,14 +151,21 @@ func rules_init() {
 	rules = []ParseRule{
 		{
 			Prefix:     func(p *Parser, canAssign bool) { p.grouping(canAssign) }, //Left Paren
-			Infix:      nil,
-			Precedence: PREC_NONE,
+			Infix:      func(p *Parser, canAssign bool) { p.call(canAssign) },
+			Precedence: PREC_CALL,
 		},
 		{nil, nil, PREC_NONE}, // Right Paren
-		{nil, nil, PREC_NONE}, // Left Brace
+		{func(p *Parser, canAssign bool) { p.mapLiteral(canAssign) }, nil, PREC_NONE}, // Left Brace
 		{nil, nil, PREC_NONE}, // Right Brace
+		{
+			Prefix:     func(p *Parser, canAssign bool) { p.list(canAssign) }, // Left Bracket
+			Infix:      func(p *Parser, canAssign bool) { p.subscript(canAssign) },
+			Precedence: PREC_CALL,
+		},
+		{nil, nil, PREC_NONE}, // Right Bracket
 		{nil, nil, PREC_NONE}, // Comma
-		{nil, nil, PREC_NONE}, // Dot
+		{nil, func(p *Parser, canAssign bool) { p.dot(canAssign) }, PREC_CALL}, // Dot
+		{nil, nil, PREC_NONE}, // Ellipsis
 		{
 			Prefix:     func(p *Parser, canAssign bool) { p.unary(canAssign) },
 			Infix:      func(p *Parser, canAssign bool) { p.binary(canAssign) }, // Minus
@@ -82,51 +173,98 @@ func rules_init() {
 		},
 		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_TERM}, // plus
 		{nil, nil, PREC_NONE}, // Semicolon
-		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_FACTOR},   // slash
-		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_FACTOR},   // star
+		{nil, nil, PREC_NONE}, // Colon
+		{
+			Prefix:     nil,
+			Infix:      func(p *Parser, canAssign bool) { p.conditional(canAssign) }, // Question
+			Precedence: PREC_CONDITIONAL,
+		},
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_FACTOR},  // slash
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_FACTOR},  // star
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_FACTOR},  // percent
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_BIT_AND}, // ampersand
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_BIT_OR},  // pipe
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_BIT_XOR}, // caret
+		{nil, nil, PREC_NONE}, // minus equal
+		{func(p *Parser, canAssign bool) { p.prefixStep(canAssign) }, nil, PREC_NONE}, // minus minus
+		{nil, nil, PREC_NONE}, // plus equal
+		{func(p *Parser, canAssign bool) { p.prefixStep(canAssign) }, nil, PREC_NONE}, // plus plus
+		{nil, nil, PREC_NONE}, // slash equal
+		{nil, nil, PREC_NONE}, // star equal
+		{nil, func(p *Parser, canAssign bool) { p.power(canAssign) }, PREC_EXPONENT},  // star star
+		{func(p *Parser, canAssign bool) { p.unary(canAssign) }, nil, PREC_NONE},      // tilde
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_FACTOR},   // tilde slash
 		{func(p *Parser, canAssign bool) { p.unary(canAssign) }, nil, PREC_NONE},      // bang
 		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_EQUALITY}, // bang equal
 		{nil, nil, PREC_NONE}, // Equal
-		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_EQUALITY},   // Equal Equal
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_EQUALITY}, // Equal Equal
+		{nil, nil, PREC_NONE}, // Arrow
 		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_COMPARISON}, // Greater
 		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_COMPARISON}, // Greater Equal
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_SHIFT},      // Greater Greater
 		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_COMPARISON}, // Less
 		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_COMPARISON}, // Less Equal
+		{nil, func(p *Parser, canAssign bool) { p.binary(canAssign) }, PREC_SHIFT},      // Less Less
 		{func(p *Parser, canAssign bool) { p.variable(canAssign) }, nil, PREC_NONE},     // Identifier
 		{func(p *Parser, canAssign bool) { p.string(canAssign) }, nil, PREC_NONE},       // String
+		{
+			Prefix:     func(p *Parser, canAssign bool) { p.interpolation(canAssign) }, // Interpolation
+			Infix:      nil,
+			Precedence: PREC_NONE,
+		},
 		{
 			Prefix:     func(p *Parser, canAssign bool) { p.number(canAssign) }, // Number
 			Infix:      nil,
 			Precedence: PREC_NONE,
 		},
 		{nil, func(p *Parser, canAssign bool) { p.and_(canAssign) }, PREC_AND}, // And
+		{nil, nil, PREC_NONE}, // As
+		{nil, nil, PREC_NONE}, // Break
+		{nil, nil, PREC_NONE}, // Case
+		{nil, nil, PREC_NONE}, // Catch
 		{nil, nil, PREC_NONE}, // Class
+		{nil, nil, PREC_NONE}, // Const
+		{nil, nil, PREC_NONE}, // Continue
+		{nil, nil, PREC_NONE}, // Default
 		{func(p *Parser, canAssign bool) { p.literal(canAssign) }, nil, PREC_NONE}, // Else
+		{nil, nil, PREC_NONE}, // Export
 		{func(p *Parser, canAssign bool) { p.literal(canAssign) }, nil, PREC_NONE}, // False
+		{nil, nil, PREC_NONE}, // Finally
 		{nil, nil, PREC_NONE}, // For
-		{nil, nil, PREC_NONE}, // Fun
+		{nil, nil, PREC_NONE}, // From
+		{func(p *Parser, canAssign bool) { p.funExpression(canAssign) }, nil, PREC_NONE}, // Fun
 		{nil, nil, PREC_NONE}, // If
+		{nil, nil, PREC_NONE}, // Import
+		{nil, nil, PREC_NONE}, // In
 		{func(p *Parser, canAssign bool) { p.literal(canAssign) }, nil, PREC_NONE}, // NIL
 		{nil, func(p *Parser, canAssign bool) { p.or_(canAssign) }, PREC_OR},       // OR
 		{nil, nil, PREC_NONE}, // Print
 		{nil, nil, PREC_NONE}, // Return
+		{func(p *Parser, canAssign bool) { p.spawn(canAssign) }, nil, PREC_NONE}, // Spawn
 		{nil, nil, PREC_NONE}, // Super
+		{nil, nil, PREC_NONE}, // Switch
 		{nil, nil, PREC_NONE}, // This
+		{nil, nil, PREC_NONE}, // Throw
 		{func(p *Parser, canAssign bool) { p.literal(canAssign) }, nil, PREC_NONE}, // True
+		{nil, nil, PREC_NONE}, // Try
 		{nil, nil, PREC_NONE}, // Var
 		{nil, nil, PREC_NONE}, // While
+		{nil, nil, PREC_NONE}, // Yield
 		{nil, nil, PREC_NONE}, // Error
 		{nil, nil, PREC_NONE}, // Eof
 	}
 }
 
-func Compile(source string, chunk *Chunk) bool {
-	var parser Parser
+// Compile compiles source into the function for the top-level code of
+// module, or returns nil if there were compile errors.
+func Compile(source string, module *ObjModule) *ObjFunction {
+	parser := Parser{module: module, constants: make(map[string]bool)}
+	var compiler Compiler
 	scanner = &Scanner{}
 
 	scanner.InitScanner(source)
-	compiler_init()
-	compilingChunk = chunk
+	current = nil
+	parser.initCompiler(&compiler, TYPE_SCRIPT)
 	parser.hadError = false
 	parser.panicMode = false
 
@@ -137,8 +275,11 @@ func Compile(source string, chunk *Chunk) bool {
 		parser.declaration()
 	}
 
-	parser.endCompiler()
-	return !parser.hadError
+	function := parser.endCompiler()
+	if parser.hadError {
+		return nil
+	}
+	return function
 }
 
 func (parser *Parser) advance() {
@@ -148,6 +289,7 @@ func (parser *Parser) advance() {
 		if parser.current.Type != TOKEN_ERROR {
 			break
 		}
+		parser.errorAt(&parser.current, string(parser.current.start))
 	}
 }
 
@@ -172,8 +314,7 @@ func (parser *Parser) errorAt(token *Token, message string) {
 	} else {
 		fmt.Fprintf(os.Stderr, " at '%s'", string(token.start))
 	}
-	fmt.Fprintf(os.Stderr, ": %s", message)
-	fmt.Println()
+	fmt.Fprintf(os.Stderr, ": %s\n", message)
 	parser.hadError = true
 }
 
@@ -199,22 +340,28 @@ func (parser *Parser) match(Type TokenType) bool {
 }
 
 func (parser *Parser) emitByte(Byte byte) {
-	compilingChunk.WriteChunk(Byte, parser.previous.line)
+	currentChunk().WriteChunk(Byte, parser.previous.line, parser.previous.column)
 }
 
-func (parser *Parser) emitJump(instruction byte) byte {
+func (parser *Parser) emitJump(instruction byte) int {
 	parser.emitByte(instruction)
+	return parser.emitJumpOffset()
+}
+
+// emitJumpOffset emits a placeholder jump offset for patchJump to fill in.
+func (parser *Parser) emitJumpOffset() int {
 	parser.emitByte(0xff)
 	parser.emitByte(0xff)
-	return byte(len(compilingChunk.Code)) - 2
+	return len(currentChunk().Code) - 2
 }
 
 func (parser *Parser) emitReturn() {
+	parser.emitByte(OP_NIL)
 	parser.emitByte(OP_RETURN)
 }
 
 func (parser *Parser) makeConstant(value Value) byte {
-	constant := compilingChunk.AddConstant(value)
+	constant := currentChunk().AddConstant(value)
 	if constant > 255 {
 		parser.error("Too many constants in one chunk.")
 		return 0
@@ -226,15 +373,15 @@ func (parser *Parser) emitConstant(value Value) {
 	parser.emitBytes(OP_CONSTANT, parser.makeConstant(value))
 }
 
-func (parser *Parser) patchJump(offset byte) {
-	jump := len(compilingChunk.Code) - int(offset) - 2
+func (parser *Parser) patchJump(offset int) {
+	jump := len(currentChunk().Code) - offset - 2
 
-	if jump > 255 {
+	if jump > int(^uint16(0)) {
 		parser.error("Too much code to jump over")
 	}
 
-	compilingChunk.Code[offset] = byte((jump >> 8) & 0xff)
-	compilingChunk.Code[offset+1] = byte(jump & 0xff)
+	currentChunk().Code[offset] = byte((jump >> 8) & 0xff)
+	currentChunk().Code[offset+1] = byte(jump & 0xff)
 }
 
 func (parser *Parser) emitBytes(byte1, byte2 byte) {
@@ -245,7 +392,7 @@ func (parser *Parser) emitBytes(byte1, byte2 byte) {
 func (parser *Parser) emitLoop(loopStart int) {
 	parser.emitByte(OP_LOOP)
 
-	offset := len(compilingChunk.Code) - loopStart + 2
+	offset := len(currentChunk().Code) - loopStart + 2
 	if offset > int(^uint16(0)) {
 		parser.error("Loop body too large.")
 	}
@@ -254,11 +401,14 @@ func (parser *Parser) emitLoop(loopStart int) {
 	parser.emitByte(byte(offset) & 0xff)
 }
 
-func (parser *Parser) endCompiler() {
+func (parser *Parser) endCompiler() *ObjFunction {
 	parser.emitReturn()
+	function := current.function
 	if !parser.hadError {
-		// compilingChunk.DisassembleChunk("code") // comment
+		// currentChunk().DisassembleChunk("code") // comment
 	}
+	current = current.enclosing
+	return function
 }
 
 func beginScope() {
@@ -269,11 +419,55 @@ func (parser *Parser) endScope() {
 	current.scopeDepth--
 	for current.localCount > 0 &&
 		current.locals[current.localCount-1].depth > current.scopeDepth {
-		parser.emitByte(OP_POP)
+		parser.popLocal(&current.locals[current.localCount-1])
 		current.localCount--
 	}
 }
 
+// popLocal discards a local going out of scope, moving it to the heap
+// first if a closure captured it.
+func (parser *Parser) popLocal(local *Local) {
+	if local.isCaptured {
+		parser.emitByte(OP_CLOSE_UPVALUE)
+	} else {
+		parser.emitByte(OP_POP)
+	}
+}
+
+func (parser *Parser) beginLoop(start int) {
+	current.loop = &Loop{
+		enclosing:  current.loop,
+		start:      start,
+		scopeDepth: current.scopeDepth,
+		try:        current.try,
+	}
+}
+
+func (parser *Parser) endLoop() {
+	for _, jump := range current.loop.breakJumps {
+		parser.patchJump(jump)
+	}
+	current.loop = current.loop.enclosing
+}
+
+// continueLoop is the innermost loop that continue goes back to.
+func continueLoop() *Loop {
+	loop := current.loop
+	for loop != nil && loop.isSwitch {
+		loop = loop.enclosing
+	}
+	return loop
+}
+
+// discardLoopLocals pops the locals declared inside the loop body, like
+// endScope does, but leaves them declared since compilation carries on in
+// the same scope after the jump.
+func (parser *Parser) discardLoopLocals(loop *Loop) {
+	for i := current.localCount - 1; i >= 0 && current.locals[i].depth > loop.scopeDepth; i-- {
+		parser.popLocal(&current.locals[i])
+	}
+}
+
 func (parser *Parser) binary(bool) {
 	operatorType := parser.previous.Type
 	rule := getRule(operatorType)
@@ -301,11 +495,34 @@ func (parser *Parser) binary(bool) {
 		parser.emitByte(OP_MULTIPLY)
 	case TOKEN_SLASH:
 		parser.emitByte(OP_DIVIDE)
+	case TOKEN_TILDE_SLASH:
+		parser.emitByte(OP_INT_DIVIDE)
+	case TOKEN_PERCENT:
+		parser.emitByte(OP_MODULO)
+	case TOKEN_AMPERSAND:
+		parser.emitByte(OP_BIT_AND)
+	case TOKEN_PIPE:
+		parser.emitByte(OP_BIT_OR)
+	case TOKEN_CARET:
+		parser.emitByte(OP_BIT_XOR)
+	case TOKEN_LESS_LESS:
+		parser.emitByte(OP_SHIFT_LEFT)
+	case TOKEN_GREATER_GREATER:
+		parser.emitByte(OP_SHIFT_RIGHT)
 	default:
 		return
 	}
 }
 
+// power compiles `**`. It is right-associative, so its right operand is
+// parsed at its own precedence rather than one above. It binds tighter
+// than a unary minus on its left, as in Python: `-2 ** 2` is `-(2 ** 2)`.
+// A unary minus on its right is part of the exponent: `2 ** -1` is 0.5.
+func (parser *Parser) power(bool) {
+	parser.parsePrecedence(PREC_EXPONENT)
+	parser.emitByte(OP_POWER)
+}
+
 func (parser *Parser) literal(bool) {
 	switch parser.previous.Type {
 	case TOKEN_FALSE:
@@ -320,14 +537,31 @@ func (parser *Parser) literal(bool) {
 }
 
 func (parser *Parser) grouping(bool) {
+	if parser.isArrowFunction() {
+		parser.arrowFunction()
+		return
+	}
 	parser.expression()
 	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression")
 }
 
 func (parser *Parser) number(bool) {
-	value, err := strconv.ParseFloat(string(parser.previous.start), 64)
-	if err != nil {
-		panic("number() cant't convert")
+	lexeme := string(parser.previous.start)
+	var value float64
+	if len(lexeme) > 1 && lexeme[0] == '0' && strings.ContainsAny(lexeme[1:2], "xXbBoO") {
+		// Base 0 lets ParseUint read the prefix and the separators.
+		n, err := strconv.ParseUint(lexeme, 0, 64)
+		if err != nil {
+			parser.error("Number literal is too large.")
+			return
+		}
+		value = float64(n)
+	} else {
+		var err error
+		value, err = strconv.ParseFloat(strings.ReplaceAll(lexeme, "_", ""), 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			panic("number() cant't convert")
+		}
 	}
 	parser.emitConstant(NumberVal(value))
 }
@@ -343,33 +577,450 @@ func (parser *Parser) or_(bool) {
 	parser.patchJump(endJump)
 }
 
+// conditional compiles `cond ? a : b`. Both branches parse at conditional
+// precedence, so `a ? b : c ? d : e` nests to the right.
+func (parser *Parser) conditional(bool) {
+	elseJump := parser.emitJump(OP_JUMP_IF_FALSE)
+	parser.emitByte(OP_POP)
+	parser.parsePrecedence(PREC_CONDITIONAL)
+	parser.consume(TOKEN_COLON, "Expect ':' after then branch of conditional expression.")
+	endJump := parser.emitJump(OP_JUMP)
+
+	parser.patchJump(elseJump)
+	parser.emitByte(OP_POP)
+	parser.parsePrecedence(PREC_CONDITIONAL)
+	parser.patchJump(endJump)
+}
+
+func (parser *Parser) list(bool) {
+	count := 0
+	if !parser.check(TOKEN_RIGHT_BRACKET) {
+		for {
+			if parser.check(TOKEN_RIGHT_BRACKET) {
+				break // Trailing comma.
+			}
+			parser.expression()
+			if count == 255 {
+				parser.error("Can't have more than 255 elements in a list literal.")
+			}
+			count++
+			if !parser.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	parser.consume(TOKEN_RIGHT_BRACKET, "Expect ']' after list elements.")
+	parser.emitBytes(OP_BUILD_LIST, byte(count))
+}
+
+// mapLiteral compiles `{key: value, ...}`. A '{' only reaches here in
+// expression position; at the start of a statement it opens a block.
+func (parser *Parser) mapLiteral(bool) {
+	count := 0
+	for !parser.check(TOKEN_RIGHT_BRACE) {
+		parser.expression()
+		parser.consume(TOKEN_COLON, "Expect ':' after map key.")
+		parser.expression()
+		if count == 255 {
+			parser.error("Can't have more than 255 entries in a map literal.")
+		}
+		count++
+		if !parser.match(TOKEN_COMMA) {
+			break
+		}
+	}
+	parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after map entries.")
+	parser.emitBytes(OP_BUILD_MAP, byte(count))
+}
+
+func (parser *Parser) subscript(canAssign bool) {
+	parser.expression()
+	parser.consume(TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+
+	if canAssign && parser.match(TOKEN_EQUAL) {
+		parser.expression()
+		parser.emitByte(OP_SET_INDEX)
+	} else if op, ok := parser.matchCompound(canAssign); ok {
+		parser.emitBytes(OP_DUP2, OP_GET_INDEX)
+		parser.expression()
+		parser.emitBytes(op, OP_SET_INDEX)
+	} else if op, ok := parser.matchStep(); ok {
+		// Keep a copy of the old value under the receiver and index so
+		// it is what's left once SET_INDEX has stored the new one.
+		parser.emitBytes(OP_DUP2, OP_GET_INDEX)
+		parser.emitByte(OP_DUP)
+		parser.emitBytes(OP_BURY, 3)
+		parser.emitConstant(NumberVal(1))
+		parser.emitBytes(op, OP_SET_INDEX)
+		parser.emitByte(OP_POP)
+	} else {
+		parser.emitByte(OP_GET_INDEX)
+	}
+}
+
+func (parser *Parser) dot(bool) {
+	// A keyword can name a property too, as in Fiber.yield().
+	if parser.current.Type >= TOKEN_AND && parser.current.Type <= TOKEN_YIELD {
+		parser.advance()
+	} else {
+		parser.consume(TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	}
+	name := parser.identifierConstant(parser.previous)
+
+	if !parser.match(TOKEN_LEFT_PAREN) {
+		parser.emitBytes(OP_GET_PROPERTY, name)
+		return
+	}
+	argCount, names, spread := parser.argumentList()
+	if names != nil {
+		parser.error("Methods don't take keyword arguments.")
+	} else if spread {
+		parser.error("Can't spread arguments to a method.")
+	}
+	parser.emitBytes(OP_INVOKE, name)
+	parser.emitByte(argCount)
+}
+
+// call compiles the arguments of a call. Keyword arguments follow the
+// positional ones on the stack, and OP_CALL_NAMED carries their names.
+// When an argument is spread, the positional ones are gathered into a
+// list instead, which OP_CALL_SPREAD unpacks.
+func (parser *Parser) call(bool) {
+	argCount, names, spread := parser.argumentList()
+	parser.emitCall(argCount, names, spread, false)
+}
+
+// emitCall emits the instruction that makes a call whose arguments have
+// been compiled, or with spawn set, the one that makes it on a new thread.
+func (parser *Parser) emitCall(argCount byte, names []Value, spread bool, spawn bool) {
+	call, callNamed, callSpread := byte(OP_CALL), byte(OP_CALL_NAMED), byte(OP_CALL_SPREAD)
+	if spawn {
+		call, callNamed, callSpread = OP_SPAWN, OP_SPAWN_NAMED, OP_SPAWN_SPREAD
+	}
+	switch {
+	case spread:
+		parser.emitBytes(callSpread, parser.makeConstant(ObjVal(newList(names))))
+	case names != nil:
+		parser.emitBytes(callNamed, argCount)
+		parser.emitByte(parser.makeConstant(ObjVal(newList(names))))
+	default:
+		parser.emitBytes(call, argCount)
+	}
+}
+
+// spawn compiles `spawn f(args)`. The callee and whatever follows it are
+// parsed as they would be at call precedence, except that the last call
+// in the chain is made on a new thread, leaving the thread.
+func (parser *Parser) spawn(bool) {
+	parser.advance()
+	prefixRule := getRule(parser.previous.Type).Prefix
+	if prefixRule == nil {
+		parser.error("Expect expression.")
+		return
+	}
+	prefixRule(parser, false)
+
+	for PREC_CALL <= getRule(parser.current.Type).Precedence {
+		parser.advance()
+		if parser.previous.Type != TOKEN_LEFT_PAREN {
+			getRule(parser.previous.Type).Infix(parser, false)
+			continue
+		}
+		// Only once the arguments are parsed is it clear whether another
+		// call follows this one.
+		argCount, names, spread := parser.argumentList()
+		last := getRule(parser.current.Type).Precedence < PREC_CALL
+		parser.emitCall(argCount, names, spread, last)
+		if last {
+			return
+		}
+	}
+	parser.error("Expect a function call after 'spawn'.")
+}
+
+// argumentList compiles arguments through the closing ')' and returns
+// their count, the names of any keyword arguments among them, and whether
+// any argument was spread.
+func (parser *Parser) argumentList() (byte, []Value, bool) {
+	argCount := 0
+	var names []Value
+	spread := false
+	if !parser.check(TOKEN_RIGHT_PAREN) {
+		for {
+			if parser.match(TOKEN_ELLIPSIS) {
+				if names != nil {
+					parser.error("Spread argument can't follow keyword arguments.")
+				}
+				if !spread {
+					parser.emitBytes(OP_BUILD_LIST, byte(argCount))
+					spread = true
+				}
+				parser.expression()
+				parser.emitByte(OP_EXTEND)
+			} else if parser.isKeywordArgument() {
+				parser.advance()
+				name := StringVal(string(parser.previous.start))
+				if slices.Contains(names, name) {
+					parser.error("Duplicate keyword argument.")
+				}
+				names = append(names, name)
+				parser.advance()
+				parser.expression()
+			} else {
+				if names != nil {
+					parser.errorAt(&parser.current, "Positional argument can't follow keyword arguments.")
+				}
+				parser.expression()
+				if spread {
+					parser.emitBytes(OP_BUILD_LIST, 1)
+					parser.emitByte(OP_EXTEND)
+				}
+			}
+			if argCount == 255 {
+				parser.error("Can't have more than 255 arguments.")
+			}
+			argCount++
+			if !parser.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
+	return byte(argCount), names, spread
+}
+
+// isKeywordArgument reports whether the next argument is `name: value`.
+func (parser *Parser) isKeywordArgument() bool {
+	if !parser.check(TOKEN_IDENTIFIER) {
+		return false
+	}
+	lookahead := lookahead()
+	return lookahead.scanToken().Type == TOKEN_COLON
+}
+
 func (parser *Parser) string(bool) {
-	value := string(parser.previous.start[1 : len(parser.previous.start)-1])
+	value := unescape(parser.previous.start[1 : len(parser.previous.start)-1])
 	parser.emitConstant(StringVal(value))
 }
 
-func (parser *Parser) namedVariable(name Token, canAssign bool) {
-	var getOp, setOp uint8
+// interpolation compiles a string with `${}` expressions in it. Each
+// expression is converted to a string and the pieces are concatenated
+// left to right; empty segments are skipped.
+func (parser *Parser) interpolation(bool) {
+	pieces := 0
+	piece := func() {
+		if pieces > 0 {
+			parser.emitByte(OP_ADD)
+		}
+		pieces++
+	}
+	segment := func(body []rune) {
+		if len(body) > 0 {
+			parser.emitConstant(StringVal(unescape(body)))
+			piece()
+		}
+	}
+
+	for {
+		// Drop the opening `"` or `}` and the trailing `${`.
+		lexeme := parser.previous.start
+		segment(lexeme[1 : len(lexeme)-2])
+		if parser.checkSegment() {
+			parser.error("Expect expression after '${'.")
+			return
+		}
+		parser.expression()
+		parser.emitByte(OP_TO_STRING)
+		piece()
+
+		if !parser.checkSegment() {
+			parser.errorAtCurrent("Expect '}' after interpolated expression.")
+			return
+		}
+		parser.advance()
+		if parser.previous.Type == TOKEN_STRING {
+			break
+		}
+	}
+
+	lexeme := parser.previous.start
+	segment(lexeme[1 : len(lexeme)-1])
+}
+
+// checkSegment reports whether the current token is the rest of a string
+// after an interpolated expression. It starts with the `}` that closed the
+// expression, which tells it apart from an unrelated string.
+func (parser *Parser) checkSegment() bool {
+	return (parser.check(TOKEN_STRING) || parser.check(TOKEN_INTERPOLATION)) &&
+		parser.current.start[0] == '}'
+}
+
+// unescape decodes the escape sequences in the body of a string literal.
+// The scanner has already rejected malformed ones.
+func unescape(body []rune) string {
+	var builder strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			builder.WriteRune(body[i])
+			continue
+		}
+		i++
+		switch body[i] {
+		case 'n':
+			builder.WriteByte('\n')
+		case 't':
+			builder.WriteByte('\t')
+		case 'r':
+			builder.WriteByte('\r')
+		case '0':
+			builder.WriteByte(0)
+		case 'x':
+			codePoint, _ := strconv.ParseUint(string(body[i+1:i+3]), 16, 8)
+			builder.WriteRune(rune(codePoint))
+			i += 2
+		case 'u':
+			end := i + 2
+			for body[end] != '}' {
+				end++
+			}
+			codePoint, _ := strconv.ParseUint(string(body[i+2:end]), 16, 32)
+			builder.WriteRune(rune(codePoint))
+			i = end
+		default:
+			// \\, \" and \$
+			builder.WriteRune(body[i])
+		}
+	}
+	return builder.String()
+}
+
+func (parser *Parser) resolveVariable(name Token) (getOp uint8, setOp uint8, arg byte) {
 	get_arg := parser.resolveLocal(current, name)
-	var arg byte
 	if get_arg != -1 {
-		arg = byte(get_arg)
-		getOp = OP_GET_LOCAL
-		setOp = OP_SET_LOCAL
+		return OP_GET_LOCAL, OP_SET_LOCAL, byte(get_arg)
+	}
+	if get_arg = parser.resolveUpvalue(current, name); get_arg != -1 {
+		return OP_GET_UPVALUE, OP_SET_UPVALUE, byte(get_arg)
+	}
+	return OP_GET_GLOBAL, OP_SET_GLOBAL, parser.identifierConstant(name)
+}
+
+// checkAssignable reports an error if name, which has just been resolved
+// by resolveVariable, is a constant.
+func (parser *Parser) checkAssignable(name Token) {
+	var constant bool
+	if local := parser.resolveLocal(current, name); local != -1 {
+		constant = current.locals[local].constant
+	} else if upvalue := parser.resolveUpvalue(current, name); upvalue != -1 {
+		constant = current.upvalues[upvalue].constant
 	} else {
-		arg = parser.identifierConstant(name)
-		getOp = OP_GET_GLOBAL
-		setOp = OP_SET_GLOBAL
+		constant = parser.isGlobalConstant(name)
 	}
+	if constant {
+		parser.errorAt(&name, fmt.Sprintf("Cannot assign to constant '%s'.", string(name.start)))
+	}
+}
+
+func (parser *Parser) isGlobalConstant(name Token) bool {
+	return parser.constants[string(name.start)] || parser.module.Constants[string(name.start)]
+}
+
+func (parser *Parser) namedVariable(name Token, canAssign bool) {
+	getOp, setOp, arg := parser.resolveVariable(name)
 
 	if canAssign && parser.match(TOKEN_EQUAL) {
+		parser.checkAssignable(name)
 		parser.expression()
 		parser.emitBytes(setOp, arg)
+	} else if op, ok := parser.matchCompound(canAssign); ok {
+		parser.checkAssignable(name)
+		parser.emitBytes(getOp, arg)
+		parser.expression()
+		parser.emitByte(op)
+		parser.emitBytes(setOp, arg)
+	} else if op, ok := parser.matchStep(); ok {
+		parser.checkAssignable(name)
+		// The first read is the postfix expression's value.
+		parser.emitBytes(getOp, arg)
+		parser.emitBytes(getOp, arg)
+		parser.emitConstant(NumberVal(1))
+		parser.emitByte(op)
+		parser.emitBytes(setOp, arg)
+		parser.emitByte(OP_POP)
 	} else {
 		parser.emitBytes(getOp, arg)
 	}
 }
 
+// compoundOps maps each compound assignment operator to the instruction
+// that combines the target's value with the right-hand side.
+var compoundOps = map[TokenType]uint8{
+	TOKEN_PLUS_EQUAL:  OP_ADD,
+	TOKEN_MINUS_EQUAL: OP_SUBTRACT,
+	TOKEN_STAR_EQUAL:  OP_MULTIPLY,
+	TOKEN_SLASH_EQUAL: OP_DIVIDE,
+}
+
+func (parser *Parser) matchCompound(canAssign bool) (uint8, bool) {
+	op, ok := compoundOps[parser.current.Type]
+	if !canAssign || !ok {
+		return 0, false
+	}
+	parser.advance()
+	return op, true
+}
+
+// matchStep consumes a postfix `++` or `--` and returns the instruction
+// that applies it.
+func (parser *Parser) matchStep() (uint8, bool) {
+	switch {
+	case parser.match(TOKEN_PLUS_PLUS):
+		return OP_ADD, true
+	case parser.match(TOKEN_MINUS_MINUS):
+		return OP_SUBTRACT, true
+	}
+	return 0, false
+}
+
+// prefixStep compiles `++target` and `--target`. The target is parsed here
+// rather than as an operand so that only a variable or a subscript of one
+// is accepted, and the expression's value is the updated one.
+func (parser *Parser) prefixStep(bool) {
+	var op uint8 = OP_ADD
+	if parser.previous.Type == TOKEN_MINUS_MINUS {
+		op = OP_SUBTRACT
+	}
+	if !parser.match(TOKEN_IDENTIFIER) {
+		parser.error("Invalid assignment target.")
+		return
+	}
+	name := parser.previous
+
+	if !parser.check(TOKEN_LEFT_BRACKET) {
+		getOp, setOp, arg := parser.resolveVariable(name)
+		parser.checkAssignable(name)
+		parser.emitBytes(getOp, arg)
+		parser.emitConstant(NumberVal(1))
+		parser.emitByte(op)
+		parser.emitBytes(setOp, arg)
+		return
+	}
+
+	parser.namedVariable(name, false)
+	for {
+		parser.advance()
+		parser.expression()
+		parser.consume(TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+		if !parser.check(TOKEN_LEFT_BRACKET) {
+			break
+		}
+		parser.emitByte(OP_GET_INDEX)
+	}
+	parser.emitBytes(OP_DUP2, OP_GET_INDEX)
+	parser.emitConstant(NumberVal(1))
+	parser.emitBytes(op, OP_SET_INDEX)
+}
+
 func (parser *Parser) variable(canAssign bool) {
 	parser.namedVariable(parser.previous, canAssign)
 }
@@ -385,6 +1036,8 @@ func (parser *Parser) unary(bool) {
 		parser.emitByte(OP_NOT)
 	case TOKEN_MINUS:
 		parser.emitByte(OP_NEGATE)
+	case TOKEN_TILDE:
+		parser.emitByte(OP_BIT_NOT)
 	default:
 		return
 	}
@@ -392,6 +1045,12 @@ func (parser *Parser) unary(bool) {
 
 func (parser *Parser) parsePrecedence(precedence Precedence) {
 	parser.advance()
+	parser.parseFrom(precedence)
+}
+
+// parseFrom is parsePrecedence for an expression whose first token has
+// already been consumed.
+func (parser *Parser) parseFrom(precedence Precedence) {
 	prefixRule := getRule(parser.previous.Type).Prefix
 	if prefixRule == nil {
 		parser.error("Expect expression.\n")
@@ -407,7 +1066,7 @@ func (parser *Parser) parsePrecedence(precedence Precedence) {
 		infixRule(parser, canAssign)
 	}
 
-	if canAssign && parser.match(TOKEN_EQUAL) {
+	if _, ok := parser.matchCompound(canAssign); ok || canAssign && parser.match(TOKEN_EQUAL) {
 		parser.error("Invalid assignment target.")
 	}
 }
@@ -445,6 +1104,43 @@ func (parser *Parser) resolveLocal(compiler *Compiler, name Token) int {
 	return -1
 }
 
+// resolveUpvalue finds name in the functions enclosing compiler's, marking
+// the local it names as captured and threading an upvalue for it through
+// every function in between.
+func (parser *Parser) resolveUpvalue(compiler *Compiler, name Token) int {
+	if compiler.enclosing == nil {
+		return -1
+	}
+
+	if local := parser.resolveLocal(compiler.enclosing, name); local != -1 {
+		compiler.enclosing.locals[local].isCaptured = true
+		constant := compiler.enclosing.locals[local].constant
+		return parser.addUpvalue(compiler, byte(local), true, constant)
+	}
+
+	if upvalue := parser.resolveUpvalue(compiler.enclosing, name); upvalue != -1 {
+		constant := compiler.enclosing.upvalues[upvalue].constant
+		return parser.addUpvalue(compiler, byte(upvalue), false, constant)
+	}
+	return -1
+}
+
+func (parser *Parser) addUpvalue(compiler *Compiler, index byte, isLocal bool, constant bool) int {
+	for i, upvalue := range compiler.upvalues {
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if len(compiler.upvalues) == 256 {
+		parser.error("Too many closure variables in function.")
+		return 0
+	}
+	compiler.upvalues = append(compiler.upvalues, Upvalue{index: index, isLocal: isLocal, constant: constant})
+	compiler.function.UpvalueCount = len(compiler.upvalues)
+	return len(compiler.upvalues) - 1
+}
+
 func (parser *Parser) declareVariable() {
 	if current.scopeDepth == 0 {
 		return
@@ -473,6 +1169,8 @@ func (parser *Parser) addLocal(name Token) {
 	current.localCount++
 	local.name = name
 	local.depth = -1
+	local.isCaptured = false
+	local.constant = false
 }
 
 func (parser *Parser) parseVariable(errorMessage string) byte {
@@ -483,10 +1181,17 @@ func (parser *Parser) parseVariable(errorMessage string) byte {
 		return 0
 	}
 
+	if parser.isGlobalConstant(parser.previous) {
+		parser.error(fmt.Sprintf("Cannot assign to constant '%s'.", string(parser.previous.start)))
+	}
+
 	return parser.identifierConstant(parser.previous)
 }
 
 func markInitialized() {
+	if current.scopeDepth == 0 {
+		return
+	}
 	current.locals[current.localCount-1].depth = current.scopeDepth
 }
 
@@ -521,6 +1226,181 @@ func (parser *Parser) block() {
 	parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
 }
 
+func (parser *Parser) funDeclaration() {
+	global := parser.parseVariable("Expect function name.")
+	markInitialized()
+	parser.function(TYPE_FUNCTION)
+	parser.defineVariable(global)
+}
+
+// funExpression compiles an anonymous `fun (params) { body }`.
+func (parser *Parser) funExpression(bool) {
+	if !parser.check(TOKEN_LEFT_PAREN) {
+		// A named function is a declaration, not an expression.
+		parser.error("Expect expression.")
+		return
+	}
+	parser.function(TYPE_FUNCTION)
+}
+
+func (parser *Parser) function(functionType FunctionType) {
+	var compiler Compiler
+	parser.initCompiler(&compiler, functionType)
+	beginScope()
+
+	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	parser.parameters()
+	parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	parser.block()
+
+	parser.endFunction(&compiler)
+}
+
+// lookahead returns a copy of the scanner for peeking at the tokens after
+// current without consuming them.
+func lookahead() Scanner {
+	ahead := *scanner
+	ahead.Interpolations = append([]int(nil), scanner.Interpolations...)
+	return ahead
+}
+
+// isArrowFunction reports whether the '(' just consumed opens the
+// parameters of an arrow function rather than a grouping. It scans a copy
+// of the scanner ahead to the matching ')' and looks for '=>' after it.
+func (parser *Parser) isArrowFunction() bool {
+	if !parser.check(TOKEN_RIGHT_PAREN) && !parser.check(TOKEN_IDENTIFIER) &&
+		!parser.check(TOKEN_ELLIPSIS) {
+		return false
+	}
+
+	lookahead := lookahead()
+	depth := 0
+	for token := parser.current; ; token = lookahead.scanToken() {
+		switch token.Type {
+		case TOKEN_LEFT_PAREN, TOKEN_LEFT_BRACKET, TOKEN_LEFT_BRACE:
+			depth++
+		case TOKEN_RIGHT_PAREN, TOKEN_RIGHT_BRACKET, TOKEN_RIGHT_BRACE:
+			if depth == 0 {
+				return token.Type == TOKEN_RIGHT_PAREN && lookahead.scanToken().Type == TOKEN_ARROW
+			}
+			depth--
+		case TOKEN_EOF:
+			return false
+		}
+	}
+}
+
+// arrowFunction compiles `(params) => expression`, which returns the
+// value of its expression. A '{' after the arrow always opens a block
+// body, as in `(x) => { print x; }`, which returns only what its return
+// statements do. An arrow that returns a map literal wraps it in
+// parentheses: `() => ({"a": 1})`.
+func (parser *Parser) arrowFunction() {
+	var compiler Compiler
+	parser.initCompiler(&compiler, TYPE_FUNCTION)
+	beginScope()
+
+	parser.parameters()
+	parser.consume(TOKEN_ARROW, "Expect '=>' after parameters.")
+	if parser.match(TOKEN_LEFT_BRACE) {
+		parser.block()
+	} else {
+		parser.expression()
+		parser.emitByte(OP_RETURN)
+	}
+
+	parser.endFunction(&compiler)
+}
+
+// parameters compiles a parameter list through its closing ')'. A default
+// value is compiled into the start of the body, where it runs only when
+// the caller passed nothing for its parameter. A last `...name` parameter
+// collects any surplus arguments into a list.
+func (parser *Parser) parameters() {
+	if !parser.check(TOKEN_RIGHT_PAREN) {
+		for {
+			function := current.function
+			function.Arity++
+			if function.Arity > 255 {
+				parser.errorAtCurrent("Can't have more than 255 parameters.")
+			}
+			function.Variadic = parser.match(TOKEN_ELLIPSIS)
+			constant := parser.parseVariable("Expect parameter name.")
+			function.Params = append(function.Params, string(parser.previous.start))
+			parser.defineVariable(constant)
+			if parser.match(TOKEN_EQUAL) {
+				if function.Variadic {
+					parser.error("Rest parameter can't have a default.")
+				}
+				parser.defaultValue(byte(current.localCount - 1))
+			} else if function.Variadic {
+				if parser.check(TOKEN_COMMA) {
+					parser.errorAt(&parser.current, "Rest parameter must be last.")
+				}
+			} else if function.Required < function.Arity-1 {
+				parser.error("Parameters with defaults must come last.")
+			} else {
+				function.Required++
+			}
+			if !parser.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+}
+
+func (parser *Parser) defaultValue(slot byte) {
+	parser.emitBytes(OP_SKIP_DEFAULT, slot)
+	skip := parser.emitJumpOffset()
+	parser.expression()
+	parser.emitBytes(OP_SET_LOCAL, slot)
+	parser.emitByte(OP_POP)
+	parser.patchJump(skip)
+}
+
+// endFunction finishes the function being compiled and emits the closure
+// for it, followed by where each of its upvalues is captured from.
+func (parser *Parser) endFunction(compiler *Compiler) {
+	function := parser.endCompiler()
+	parser.emitBytes(OP_CLOSURE, parser.makeConstant(ObjVal(function)))
+	for _, upvalue := range compiler.upvalues {
+		var isLocal byte
+		if upvalue.isLocal {
+			isLocal = 1
+		}
+		parser.emitBytes(isLocal, upvalue.index)
+	}
+}
+
+func (parser *Parser) returnStatement() {
+	if current.functionType == TYPE_SCRIPT {
+		parser.error("Can't return from top-level code.")
+	}
+
+	if parser.match(TOKEN_SEMICOLON) {
+		parser.emitByte(OP_NIL)
+	} else {
+		parser.expression()
+		parser.consume(TOKEN_SEMICOLON, "Expect ';' after return value.")
+	}
+	parser.emitReturnValue()
+}
+
+// emitReturnValue returns the value on top of the stack, first running the
+// finally blocks of any try statements it leaves.
+func (parser *Parser) emitReturnValue() {
+	try := current.try
+	if try == nil {
+		parser.emitByte(OP_RETURN)
+		return
+	}
+	parser.exitThroughFinally(true, func() {
+		parser.emitBytes(OP_GET_LOCAL, try.value)
+		parser.emitReturnValue()
+	})
+}
+
 func (parser *Parser) varDeclaration() {
 	global := parser.parseVariable("Expect variable name.")
 	if parser.match(TOKEN_EQUAL) {
@@ -534,6 +1414,90 @@ func (parser *Parser) varDeclaration() {
 	parser.defineVariable(global)
 }
 
+// importDeclaration compiles `import "path" as name;`, which binds the
+// module to a variable. Without `as` the module is only run.
+func (parser *Parser) importDeclaration() {
+	path := parser.modulePath("Expect module path after 'import'.")
+	parser.emitBytes(OP_IMPORT, path)
+	if parser.match(TOKEN_AS) {
+		global := parser.parseVariable("Expect module name after 'as'.")
+		parser.consume(TOKEN_SEMICOLON, "Expect ';' after import.")
+		parser.defineVariable(global)
+	} else {
+		parser.consume(TOKEN_SEMICOLON, "Expect ';' after import.")
+		parser.emitByte(OP_POP)
+	}
+}
+
+// fromImport compiles `from "path" import a, b;`, which binds each name
+// to what the module exports under it. The module is imported again for
+// every name, which once it has loaded is only a lookup.
+func (parser *Parser) fromImport() {
+	path := parser.modulePath("Expect module path after 'from'.")
+	parser.consume(TOKEN_IMPORT, "Expect 'import' after module path.")
+	for {
+		global := parser.parseVariable("Expect name to import.")
+		name := parser.identifierConstant(parser.previous)
+		parser.emitBytes(OP_IMPORT, path)
+		parser.emitBytes(OP_GET_PROPERTY, name)
+		parser.defineVariable(global)
+		if !parser.match(TOKEN_COMMA) {
+			break
+		}
+	}
+	parser.consume(TOKEN_SEMICOLON, "Expect ';' after imported names.")
+}
+
+func (parser *Parser) modulePath(errorMessage string) byte {
+	parser.consume(TOKEN_STRING, errorMessage)
+	path := parser.previous.start
+	if parser.previous.Type != TOKEN_STRING {
+		return 0
+	}
+	return parser.makeConstant(StringVal(unescape(path[1 : len(path)-1])))
+}
+
+// exportDeclaration compiles a top-level variable or function declaration
+// and lets other modules read its name.
+func (parser *Parser) exportDeclaration() {
+	if current.enclosing != nil || current.scopeDepth > 0 {
+		parser.error("Can only export top-level declarations.")
+	}
+	var name Token
+	if parser.match(TOKEN_VAR) {
+		name = parser.current
+		parser.varDeclaration()
+	} else if parser.match(TOKEN_CONST) {
+		name = parser.current
+		parser.constDeclaration()
+	} else if parser.match(TOKEN_FUN) {
+		name = parser.current
+		parser.funDeclaration()
+	} else {
+		parser.errorAtCurrent("Expect variable or function declaration after 'export'.")
+		return
+	}
+	parser.module.Exports[string(name.start)] = true
+}
+
+// constDeclaration compiles `const name = value;`. Assigning to the
+// variable afterwards is a compile error.
+func (parser *Parser) constDeclaration() {
+	global := parser.parseVariable("Expect constant name.")
+	name := parser.previous
+	parser.consume(TOKEN_EQUAL, "Expect '=' after constant name.")
+	parser.expression()
+	parser.consume(TOKEN_SEMICOLON, "Expect ';' after constant declaration.")
+
+	if current.scopeDepth > 0 {
+		current.locals[current.localCount-1].constant = true
+		markInitialized()
+		return
+	}
+	parser.constants[string(name.start)] = true
+	parser.emitBytes(OP_DEFINE_CONST, global)
+}
+
 func (parser *Parser) expressionStatement() {
 	parser.expression()
 	parser.consume(TOKEN_SEMICOLON, "Expect ';' after expression.")
@@ -543,6 +1507,11 @@ func (parser *Parser) expressionStatement() {
 func (parser *Parser) forStatement() {
 	beginScope()
 	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'")
+	if parser.isForIn() {
+		parser.forInLoop()
+		parser.endScope()
+		return
+	}
 	if parser.match(TOKEN_SEMICOLON) {
 		// No initializer.
 	} else if parser.match(TOKEN_VAR) {
@@ -551,19 +1520,19 @@ func (parser *Parser) forStatement() {
 		parser.expressionStatement()
 	}
 
-	loopStart := len(compilingChunk.Code)
+	loopStart := len(currentChunk().Code)
 	exitJump := -1
 	if !parser.match(TOKEN_SEMICOLON) {
 		parser.expression()
 		parser.consume(TOKEN_SEMICOLON, "Expect ';' after loop condition.")
 
-		exitJump = int(parser.emitJump(OP_JUMP_IF_FALSE))
+		exitJump = parser.emitJump(OP_JUMP_IF_FALSE)
 		parser.emitByte(OP_POP)
 	}
 
 	if !parser.match(TOKEN_RIGHT_PAREN) {
 		bodyJump := parser.emitJump(OP_JUMP)
-		incrementStart := len(compilingChunk.Code)
+		incrementStart := len(currentChunk().Code)
 		parser.expression()
 		parser.emitByte(OP_POP)
 		parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
@@ -573,15 +1542,363 @@ func (parser *Parser) forStatement() {
 		parser.patchJump(bodyJump)
 	}
 
+	parser.beginLoop(loopStart)
 	parser.statement()
 	parser.emitLoop(loopStart)
 	if exitJump != -1 {
-		parser.patchJump(byte(exitJump))
+		parser.patchJump(exitJump)
 		parser.emitByte(OP_POP)
 	}
+	parser.endLoop()
 	parser.endScope()
 }
 
+// isForIn reports whether the for loop whose '(' was just consumed is
+// `for (var name in iterable)`.
+func (parser *Parser) isForIn() bool {
+	if !parser.check(TOKEN_VAR) {
+		return false
+	}
+	ahead := lookahead()
+	return ahead.scanToken().Type == TOKEN_IDENTIFIER && ahead.scanToken().Type == TOKEN_IN
+}
+
+// forInLoop compiles the rest of `for (var name in iterable) body`. The
+// iterable and the position in it live in hidden locals, and each
+// iteration declares name afresh, so closures capture separate items.
+// OP_FOR_ITER pushes nil instead of an item when it leaves the loop.
+func (parser *Parser) forInLoop() {
+	parser.consume(TOKEN_VAR, "Expect 'var' before loop variable.")
+	parser.consume(TOKEN_IDENTIFIER, "Expect variable name.")
+	name := parser.previous
+	parser.consume(TOKEN_IN, "Expect 'in' after loop variable.")
+	parser.expression()
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+	parser.addLocal(Token{start: []rune{}})
+	markInitialized()
+	iterable := byte(current.localCount - 1)
+	parser.emitConstant(NumberVal(0))
+	parser.addLocal(Token{start: []rune{}})
+	markInitialized()
+
+	loopStart := len(currentChunk().Code)
+	parser.emitBytes(OP_FOR_ITER, iterable)
+	exitJump := parser.emitJumpOffset()
+
+	parser.beginLoop(loopStart)
+	beginScope()
+	parser.addLocal(name)
+	markInitialized()
+	parser.statement()
+	parser.endScope()
+	parser.emitLoop(loopStart)
+
+	parser.patchJump(exitJump)
+	parser.emitByte(OP_POP)
+	parser.endLoop()
+}
+
+func (parser *Parser) breakStatement() {
+	if current.loop == nil {
+		parser.error("Can't use 'break' outside of a loop.")
+	}
+	parser.consume(TOKEN_SEMICOLON, "Expect ';' after 'break'.")
+	if current.loop == nil {
+		return
+	}
+	parser.emitBreak()
+}
+
+func (parser *Parser) emitBreak() {
+	if current.try != current.loop.try {
+		parser.exitThroughFinally(false, parser.emitBreak)
+		return
+	}
+	parser.discardLoopLocals(current.loop)
+	current.loop.breakJumps = append(current.loop.breakJumps, parser.emitJump(OP_JUMP))
+}
+
+func (parser *Parser) continueStatement() {
+	if continueLoop() == nil {
+		parser.error("Can't use 'continue' outside of a loop.")
+	}
+	parser.consume(TOKEN_SEMICOLON, "Expect ';' after 'continue'.")
+	if continueLoop() == nil {
+		return
+	}
+	parser.emitContinue()
+}
+
+func (parser *Parser) emitContinue() {
+	loop := continueLoop()
+	if current.try != loop.try {
+		parser.exitThroughFinally(false, parser.emitContinue)
+		return
+	}
+	parser.discardLoopLocals(loop)
+	parser.emitLoop(loop.start)
+}
+
+// switchStatement compiles a switch as a chain of comparisons with the
+// value, which is kept in a hidden local. A case's body ends by jumping
+// past the others, so nothing falls through, and break leaves the switch.
+func (parser *Parser) switchStatement() {
+	beginScope()
+	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'switch'.")
+	parser.expression()
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after value.")
+	parser.addLocal(Token{start: []rune{}})
+	markInitialized()
+	value := byte(current.localCount - 1)
+	parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before switch cases.")
+
+	parser.beginLoop(-1)
+	current.loop.isSwitch = true
+	var endJumps []int
+	hasDefault := false
+	for !parser.check(TOKEN_RIGHT_BRACE) && !parser.check(TOKEN_EOF) {
+		if parser.match(TOKEN_CASE) {
+			if hasDefault {
+				parser.error("Can't have a case after the default case.")
+			}
+			// Each value but the last jumps to the body when it matches;
+			// the last falls into it, and skips it when it doesn't.
+			var bodyJumps []int
+			var nextCase int
+			for {
+				parser.emitBytes(OP_GET_LOCAL, value)
+				parser.expression()
+				parser.emitByte(OP_EQUAL)
+				nextCase = parser.emitJump(OP_JUMP_IF_FALSE)
+				parser.emitByte(OP_POP)
+				if !parser.match(TOKEN_COMMA) {
+					break
+				}
+				bodyJumps = append(bodyJumps, parser.emitJump(OP_JUMP))
+				parser.patchJump(nextCase)
+				parser.emitByte(OP_POP)
+			}
+			parser.consume(TOKEN_COLON, "Expect ':' after case value.")
+			for _, jump := range bodyJumps {
+				parser.patchJump(jump)
+			}
+			parser.caseBody()
+			endJumps = append(endJumps, parser.emitJump(OP_JUMP))
+			parser.patchJump(nextCase)
+			parser.emitByte(OP_POP)
+		} else if parser.match(TOKEN_DEFAULT) {
+			if hasDefault {
+				parser.error("Can't have more than one default case.")
+			}
+			hasDefault = true
+			parser.consume(TOKEN_COLON, "Expect ':' after 'default'.")
+			parser.caseBody()
+		} else {
+			parser.errorAtCurrent("Expect 'case' or 'default'.")
+			break
+		}
+	}
+
+	for _, jump := range endJumps {
+		parser.patchJump(jump)
+	}
+	parser.endLoop()
+	parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after switch cases.")
+	parser.endScope()
+}
+
+// caseBody compiles the statements of a case, up to the next case or the
+// end of the switch, in a scope of their own.
+func (parser *Parser) caseBody() {
+	beginScope()
+	for !parser.check(TOKEN_CASE) && !parser.check(TOKEN_DEFAULT) &&
+		!parser.check(TOKEN_RIGHT_BRACE) && !parser.check(TOKEN_EOF) {
+		parser.declaration()
+	}
+	parser.endScope()
+}
+
+// yieldStatement makes the function it is in a generator, which hands
+// back the value and suspends here each time it is resumed.
+func (parser *Parser) yieldStatement() {
+	if current.functionType == TYPE_SCRIPT {
+		parser.error("Can't yield from top-level code.")
+	}
+	current.function.Generator = true
+
+	if parser.match(TOKEN_SEMICOLON) {
+		parser.emitByte(OP_NIL)
+	} else {
+		parser.expression()
+		parser.consume(TOKEN_SEMICOLON, "Expect ';' after yielded value.")
+	}
+	parser.emitByte(OP_YIELD)
+}
+
+func (parser *Parser) throwStatement() {
+	parser.expression()
+	parser.consume(TOKEN_SEMICOLON, "Expect ';' after thrown value.")
+	parser.emitByte(OP_THROW)
+}
+
+// tryStatement compiles try/catch/finally. The chunk's handler table sends
+// an exception thrown in the try block to the catch clause, and one thrown
+// in either to code that runs the finally block and then rethrows it.
+func (parser *Parser) tryStatement() {
+	beginScope()
+	var try *Try
+	if parser.hasFinally() {
+		try = &Try{enclosing: current.try}
+		try.completion = parser.hiddenLocal()
+		try.value = parser.hiddenLocal()
+		try.localCount = current.localCount
+		current.try = try
+	}
+	depth := current.localCount
+
+	start := len(currentChunk().Code)
+	parser.consume(TOKEN_LEFT_BRACE, "Expect '{' after 'try'.")
+	beginScope()
+	parser.block()
+	parser.endScope()
+	end := len(currentChunk().Code)
+
+	if parser.match(TOKEN_CATCH) {
+		skipCatch := parser.emitJump(OP_JUMP)
+		parser.addHandler(start, end, depth)
+		beginScope()
+		if parser.match(TOKEN_LEFT_PAREN) {
+			parser.consume(TOKEN_IDENTIFIER, "Expect exception variable name.")
+			parser.addLocal(parser.previous)
+			markInitialized()
+			parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after exception variable.")
+		} else {
+			parser.emitByte(OP_POP)
+		}
+		parser.consume(TOKEN_LEFT_BRACE, "Expect '{' after catch clause.")
+		parser.block()
+		parser.endScope()
+		parser.patchJump(skipCatch)
+	} else if try == nil {
+		parser.errorAtCurrent("Expect 'catch' or 'finally' after try block.")
+	}
+
+	if try != nil {
+		parser.finallyClause(try, start, depth)
+	}
+	parser.endScope()
+}
+
+// finallyClause compiles the finally block of the try statement whose
+// code began at start, followed by the dispatch on how it was entered.
+func (parser *Parser) finallyClause(try *Try, start int, depth int) {
+	end := len(currentChunk().Code)
+	skipThrow := parser.emitJump(OP_JUMP)
+	parser.addHandler(start, end, depth)
+	parser.exitThroughFinally(true, func() {
+		parser.emitBytes(OP_GET_LOCAL, try.value)
+		parser.emitByte(OP_THROW)
+	})
+	parser.patchJump(skipThrow)
+
+	for _, exit := range try.exits {
+		parser.patchJump(exit.jump)
+	}
+	current.try = try.enclosing
+	parser.consume(TOKEN_FINALLY, "Expect 'finally'.")
+	parser.consume(TOKEN_LEFT_BRACE, "Expect '{' after 'finally'.")
+	beginScope()
+	parser.block()
+	parser.endScope()
+
+	// Falling off the end of the try or catch block leaves completion nil,
+	// matching none of the exits.
+	for _, exit := range try.exits {
+		parser.emitBytes(OP_GET_LOCAL, try.completion)
+		parser.emitConstant(NumberVal(float64(exit.code)))
+		parser.emitByte(OP_EQUAL)
+		next := parser.emitJump(OP_JUMP_IF_FALSE)
+		parser.emitByte(OP_POP)
+		exit.resume()
+		parser.patchJump(next)
+		parser.emitByte(OP_POP)
+	}
+}
+
+// exitThroughFinally leaves the innermost try statement with a finally
+// clause by way of that clause, which then calls resume. If carry is set,
+// the value on top of the stack goes along in the try's value slot.
+func (parser *Parser) exitThroughFinally(carry bool, resume func()) {
+	try := current.try
+	if carry {
+		parser.emitBytes(OP_SET_LOCAL, try.value)
+		parser.emitByte(OP_POP)
+	}
+	for i := current.localCount - 1; i >= try.localCount; i-- {
+		parser.popLocal(&current.locals[i])
+	}
+	code := len(try.exits) + 1
+	parser.emitConstant(NumberVal(float64(code)))
+	parser.emitBytes(OP_SET_LOCAL, try.completion)
+	parser.emitByte(OP_POP)
+	try.exits = append(try.exits, tryExit{code: code, jump: parser.emitJump(OP_JUMP), resume: resume})
+}
+
+// hasFinally looks past the try block and any catch clause for a finally
+// clause, whose slots must be reserved before the try block.
+func (parser *Parser) hasFinally() bool {
+	ahead := lookahead()
+	token := parser.current
+	skip := func(open TokenType, close TokenType) {
+		if token.Type != open {
+			return
+		}
+		for depth := 0; ; token = ahead.scanToken() {
+			switch token.Type {
+			case open:
+				depth++
+			case close:
+				depth--
+				if depth == 0 {
+					token = ahead.scanToken()
+					return
+				}
+			case TOKEN_EOF:
+				return
+			}
+		}
+	}
+
+	skip(TOKEN_LEFT_BRACE, TOKEN_RIGHT_BRACE)
+	if token.Type == TOKEN_CATCH {
+		token = ahead.scanToken()
+		skip(TOKEN_LEFT_PAREN, TOKEN_RIGHT_PAREN)
+		skip(TOKEN_LEFT_BRACE, TOKEN_RIGHT_BRACE)
+	}
+	return token.Type == TOKEN_FINALLY
+}
+
+// hiddenLocal declares a local the program can't name, initialized to nil.
+func (parser *Parser) hiddenLocal() byte {
+	parser.emitByte(OP_NIL)
+	parser.addLocal(Token{start: []rune{}})
+	markInitialized()
+	return byte(current.localCount - 1)
+}
+
+// addHandler records that an exception thrown by the code from start up
+// to end lands at the current offset, with depth of the frame's stack
+// slots kept and the exception pushed above them.
+func (parser *Parser) addHandler(start int, end int, depth int) {
+	chunk := currentChunk()
+	chunk.Handlers = append(chunk.Handlers, Handler{
+		Start:  start,
+		End:    end,
+		Target: len(chunk.Code),
+		Depth:  depth,
+	})
+}
+
 func (parser *Parser) ifStatement() {
 	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
 	parser.expression()
@@ -609,18 +1926,20 @@ func (parser *Parser) printStatement() {
 }
 
 func (parser *Parser) whileStatement() {
-	loopStart := len(compilingChunk.Code)
+	loopStart := len(currentChunk().Code)
 	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
 	parser.expression()
 	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
 
 	exitJump := parser.emitJump(OP_JUMP_IF_FALSE)
 	parser.emitByte(OP_POP)
+	parser.beginLoop(loopStart)
 	parser.statement()
 	parser.emitLoop(loopStart)
 
 	parser.patchJump(exitJump)
 	parser.emitByte(OP_POP)
+	parser.endLoop()
 }
 
 func (parser *Parser) synchronize() {
@@ -634,23 +1953,50 @@ func (parser *Parser) synchronize() {
 		case TOKEN_CLASS,
 			TOKEN_FUN,
 			TOKEN_VAR,
+			TOKEN_CONST,
 			TOKEN_FOR,
 			TOKEN_IF,
 			TOKEN_WHILE,
 			TOKEN_PRINT,
-			TOKEN_RETURN:
+			TOKEN_RETURN,
+			TOKEN_YIELD,
+			TOKEN_SWITCH,
+			TOKEN_CASE,
+			TOKEN_DEFAULT,
+			TOKEN_THROW,
+			TOKEN_TRY,
+			TOKEN_IMPORT,
+			TOKEN_FROM,
+			TOKEN_EXPORT:
 			return
 		default:
 
 		}
-	}
 
-	parser.advance()
+		parser.advance()
+	}
 }
 
 func (parser *Parser) declaration() {
-	if parser.match(TOKEN_VAR) {
+	if parser.match(TOKEN_FUN) {
+		if parser.check(TOKEN_IDENTIFIER) {
+			parser.funDeclaration()
+		} else {
+			// An anonymous function starting an expression statement.
+			parser.parseFrom(PREC_ASSIGNMENT)
+			parser.consume(TOKEN_SEMICOLON, "Expect ';' after expression.")
+			parser.emitByte(OP_POP)
+		}
+	} else if parser.match(TOKEN_VAR) {
 		parser.varDeclaration()
+	} else if parser.match(TOKEN_CONST) {
+		parser.constDeclaration()
+	} else if parser.match(TOKEN_IMPORT) {
+		parser.importDeclaration()
+	} else if parser.match(TOKEN_FROM) {
+		parser.fromImport()
+	} else if parser.match(TOKEN_EXPORT) {
+		parser.exportDeclaration()
 	} else {
 		parser.statement()
 	}
@@ -663,10 +2009,24 @@ func (parser *Parser) declaration() {
 func (parser *Parser) statement() {
 	if parser.match(TOKEN_PRINT) {
 		parser.printStatement()
+	} else if parser.match(TOKEN_BREAK) {
+		parser.breakStatement()
+	} else if parser.match(TOKEN_CONTINUE) {
+		parser.continueStatement()
 	} else if parser.match(TOKEN_FOR) {
 		parser.forStatement()
 	} else if parser.match(TOKEN_IF) {
 		parser.ifStatement()
+	} else if parser.match(TOKEN_RETURN) {
+		parser.returnStatement()
+	} else if parser.match(TOKEN_YIELD) {
+		parser.yieldStatement()
+	} else if parser.match(TOKEN_THROW) {
+		parser.throwStatement()
+	} else if parser.match(TOKEN_TRY) {
+		parser.tryStatement()
+	} else if parser.match(TOKEN_SWITCH) {
+		parser.switchStatement()
 	} else if parser.match(TOKEN_WHILE) {
 		parser.whileStatement()
 	} else if parser.match(TOKEN_LEFT_BRACE) {
@@ -1,24 +1,37 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func (chunk *Chunk) DisassembleChunk(name string) {
 	fmt.Printf("== %s ==\n", name)
 	for offset := 0; offset < len(chunk.Code); {
 		offset = chunk.disassembleInstruction(offset)
 	}
+	disassembleHandlers(chunk.Handlers)
+}
+
+func disassembleHandlers(handlers []Handler) {
+	for _, handler := range handlers {
+		fmt.Printf("handler %04d-%04d -> %04d (depth %d)\n",
+			handler.Start, handler.End, handler.Target, handler.Depth)
+	}
 }
 
 func (chunk *Chunk) disassembleInstruction(offset int) int {
-	if offset >= len(chunk.Lines) {
+	line := chunk.GetLine(offset)
+	if line == -1 {
 		fmt.Printf("Error: no line info for offset %d\n", offset)
 		return offset + 1
 	}
 	fmt.Printf("%04d ", offset)
-	if offset > 0 && chunk.Lines[offset] == chunk.Lines[offset-1] {
+	if offset > 0 && line == chunk.GetLine(offset-1) {
 		fmt.Printf("   | ")
 	} else {
-		fmt.Printf("%4d ", chunk.Lines[offset])
+		fmt.Printf("%4d ", line)
 	}
 	instruction := chunk.Code[offset]
 	switch instruction {
@@ -32,6 +45,12 @@ func (chunk *Chunk) disassembleInstruction(offset int) int {
 		return simpleInstruction("OP_FALSE", offset)
 	case OP_POP:
 		return simpleInstruction("OP_POP", offset)
+	case OP_DUP:
+		return simpleInstruction("OP_DUP", offset)
+	case OP_DUP2:
+		return simpleInstruction("OP_DUP2", offset)
+	case OP_BURY:
+		return chunk.byteInstruction("OP_BURY", offset)
 	case OP_GET_LOCAL:
 		return chunk.byteInstruction("OP_GET_LOCAL", offset)
 	case OP_SET_LOCAL:
@@ -40,8 +59,14 @@ func (chunk *Chunk) disassembleInstruction(offset int) int {
 		return chunk.constantInstruction("OP_GET_GLOBAL", offset)
 	case OP_DEFINE_GLOBAL:
 		return chunk.constantInstruction("OP_DEFINE_GLOBAL", offset)
+	case OP_DEFINE_CONST:
+		return chunk.constantInstruction("OP_DEFINE_CONST", offset)
 	case OP_SET_GLOBAL:
 		return chunk.constantInstruction("OP_SET_GLOBAL", offset)
+	case OP_GET_UPVALUE:
+		return chunk.byteInstruction("OP_GET_UPVALUE", offset)
+	case OP_SET_UPVALUE:
+		return chunk.byteInstruction("OP_SET_UPVALUE", offset)
 	case OP_EQUAL:
 		return simpleInstruction("OP_EQUAL", offset)
 	case OP_GREATER:
@@ -56,10 +81,42 @@ func (chunk *Chunk) disassembleInstruction(offset int) int {
 		return simpleInstruction("OP_MULTIPLY", offset)
 	case OP_DIVIDE:
 		return simpleInstruction("OP_DIVIDE", offset)
+	case OP_INT_DIVIDE:
+		return simpleInstruction("OP_INT_DIVIDE", offset)
+	case OP_MODULO:
+		return simpleInstruction("OP_MODULO", offset)
+	case OP_POWER:
+		return simpleInstruction("OP_POWER", offset)
+	case OP_BIT_AND:
+		return simpleInstruction("OP_BIT_AND", offset)
+	case OP_BIT_OR:
+		return simpleInstruction("OP_BIT_OR", offset)
+	case OP_BIT_XOR:
+		return simpleInstruction("OP_BIT_XOR", offset)
+	case OP_SHIFT_LEFT:
+		return simpleInstruction("OP_SHIFT_LEFT", offset)
+	case OP_SHIFT_RIGHT:
+		return simpleInstruction("OP_SHIFT_RIGHT", offset)
+	case OP_BIT_NOT:
+		return simpleInstruction("OP_BIT_NOT", offset)
+	case OP_TO_STRING:
+		return simpleInstruction("OP_TO_STRING", offset)
 	case OP_NOT:
 		return simpleInstruction("OP_NOT", offset)
 	case OP_NEGATE:
 		return simpleInstruction("OP_NEGATE", offset)
+	case OP_BUILD_LIST:
+		return chunk.byteInstruction("OP_BUILD_LIST", offset)
+	case OP_BUILD_MAP:
+		return chunk.byteInstruction("OP_BUILD_MAP", offset)
+	case OP_GET_INDEX:
+		return simpleInstruction("OP_GET_INDEX", offset)
+	case OP_SET_INDEX:
+		return simpleInstruction("OP_SET_INDEX", offset)
+	case OP_GET_PROPERTY:
+		return chunk.constantInstruction("OP_GET_PROPERTY", offset)
+	case OP_INVOKE:
+		return chunk.invokeInstruction("OP_INVOKE", offset)
 	case OP_PRINT:
 		return simpleInstruction("OP_PRINT", offset)
 	case OP_JUMP:
@@ -68,6 +125,34 @@ func (chunk *Chunk) disassembleInstruction(offset int) int {
 		return chunk.jumpInstruction("OP_JUMP_IF_FALSE", 1, offset)
 	case OP_LOOP:
 		return chunk.jumpInstruction("OP_LOOP", -1, offset)
+	case OP_SKIP_DEFAULT:
+		return chunk.slotJumpInstruction("OP_SKIP_DEFAULT", offset)
+	case OP_FOR_ITER:
+		return chunk.slotJumpInstruction("OP_FOR_ITER", offset)
+	case OP_CALL:
+		return chunk.byteInstruction("OP_CALL", offset)
+	case OP_SPAWN:
+		return chunk.byteInstruction("OP_SPAWN", offset)
+	case OP_CALL_NAMED:
+		return chunk.callNamedInstruction("OP_CALL_NAMED", offset)
+	case OP_EXTEND:
+		return simpleInstruction("OP_EXTEND", offset)
+	case OP_CALL_SPREAD:
+		return chunk.constantInstruction("OP_CALL_SPREAD", offset)
+	case OP_SPAWN_NAMED:
+		return chunk.callNamedInstruction("OP_SPAWN_NAMED", offset)
+	case OP_SPAWN_SPREAD:
+		return chunk.constantInstruction("OP_SPAWN_SPREAD", offset)
+	case OP_CLOSURE:
+		return chunk.closureInstruction(offset)
+	case OP_CLOSE_UPVALUE:
+		return simpleInstruction("OP_CLOSE_UPVALUE", offset)
+	case OP_IMPORT:
+		return chunk.constantInstruction("OP_IMPORT", offset)
+	case OP_THROW:
+		return simpleInstruction("OP_THROW", offset)
+	case OP_YIELD:
+		return simpleInstruction("OP_YIELD", offset)
 	case OP_RETURN:
 		return simpleInstruction("OP_RETURN", offset)
 	default:
@@ -93,6 +178,52 @@ func (chunk *Chunk) constantInstruction(name string, offset int) int {
 	return offset + 2
 }
 
+func (chunk *Chunk) invokeInstruction(name string, offset int) int {
+	constant := chunk.Code[offset+1]
+	argCount := chunk.Code[offset+2]
+	fmt.Printf("%-16s (%d args) %4d '", name, argCount, constant)
+	printValues(chunk.Constants[constant])
+	fmt.Println("'")
+	return offset + 3
+}
+
+func (chunk *Chunk) slotJumpInstruction(name string, offset int) int {
+	slot := chunk.Code[offset+1]
+	jump := chunk.readShort(offset + 2)
+	fmt.Printf("%-16s %4d -> %d\n", name, slot, offset+4+jump)
+	return offset + 4
+}
+
+func (chunk *Chunk) callNamedInstruction(name string, offset int) int {
+	argCount := chunk.Code[offset+1]
+	constant := chunk.Code[offset+2]
+	fmt.Printf("%-16s (%d args) %4d ", name, argCount, constant)
+	printValues(chunk.Constants[constant])
+	fmt.Println()
+	return offset + 3
+}
+
+// closureInstruction prints OP_CLOSURE and the local or upvalue each of
+// the new closure's upvalues captures.
+func (chunk *Chunk) closureInstruction(offset int) int {
+	constant := chunk.Code[offset+1]
+	fmt.Printf("%-16s %4d ", "OP_CLOSURE", constant)
+	printValues(chunk.Constants[constant])
+	fmt.Println()
+	offset += 2
+
+	function := AsFunction(chunk.Constants[constant])
+	for i := 0; i < function.UpvalueCount; i++ {
+		kind := "upvalue"
+		if chunk.Code[offset] == 1 {
+			kind = "local"
+		}
+		fmt.Printf("%04d    |                     %s %d\n", offset, kind, chunk.Code[offset+1])
+		offset += 2
+	}
+	return offset
+}
+
 func simpleInstruction(name string, offset int) int {
 	fmt.Printf("%s\n", name)
 	return offset + 1
@@ -113,22 +244,233 @@ func (chunk *Chunk) jumpInstruction(name string, sign int, offset int) int {
 }
 
 func PrintValue(value Value) {
+	fmt.Print(toString(value))
+}
+
+// toString renders a value the way print shows it. Strings inside lists
+// and maps are quoted so that ["1"] and [1] read differently.
+func toString(value Value) string {
+	if IsString(value) {
+		return AsString(value)
+	}
+	var builder strings.Builder
+	writeValue(&builder, value)
+	return builder.String()
+}
+
+func writeValue(builder *strings.Builder, value Value) {
 	switch value.Type {
 	case VAL_BOOL:
-		if value.Bool {
-			fmt.Print("true")
-		} else {
-			fmt.Print("false")
-		}
+		builder.WriteString(strconv.FormatBool(value.Bool))
 	case VAL_NIL:
-		fmt.Print("nil")
+		builder.WriteString("nil")
 	case VAL_NUMBER:
-		fmt.Printf("%g", value.Num)
+		fmt.Fprintf(builder, "%g", value.Num)
 	case VAL_STRING:
-		fmt.Printf("\"%s\"", value.String)
+		fmt.Fprintf(builder, "\"%s\"", value.String)
+	case VAL_OBJ:
+		writeObject(builder, value)
+	}
+}
+
+func writeObject(builder *strings.Builder, value Value) {
+	switch OBJ_TYPE(value) {
+	case OBJ_STRING:
+		fmt.Fprintf(builder, "\"%s\"", AsString(value))
+	case OBJ_LIST:
+		writeList(builder, AsList(value))
+	case OBJ_MAP:
+		writeMap(builder, AsMap(value))
+	case OBJ_FUNCTION:
+		writeFunction(builder, AsFunction(value))
+	case OBJ_CLOSURE:
+		writeFunction(builder, AsClosure(value).Function)
+	case OBJ_NATIVE:
+		builder.WriteString("<native fn>")
+	case OBJ_ERROR:
+		fmt.Fprintf(builder, "Error: %s", AsError(value).Message)
+	case OBJ_MODULE:
+		fmt.Fprintf(builder, "<module %s>", AsModule(value).Name)
+	case OBJ_RANGE:
+		r := AsRange(value)
+		fmt.Fprintf(builder, "range(%s, %s)", toString(NumberVal(r.Start)), toString(NumberVal(r.End)))
+	case OBJ_GENERATOR:
+		if name := AsGenerator(value).Closure.Function.Name; name != "" {
+			fmt.Fprintf(builder, "<generator %s>", name)
+		} else {
+			builder.WriteString("<generator>")
+		}
+	case OBJ_FIBER:
+		builder.WriteString("<fiber>")
+	case OBJ_THREAD:
+		builder.WriteString("<thread>")
+	case OBJ_CHANNEL:
+		builder.WriteString("<channel>")
+	}
+}
+
+func writeFunction(builder *strings.Builder, function *ObjFunction) {
+	if function.Name == "" {
+		builder.WriteString("<fn>")
+		return
+	}
+	fmt.Fprintf(builder, "<fn %s>", function.Name)
+}
+
+// functionName is how a function is named in stack traces.
+func functionName(function *ObjFunction) string {
+	if function.Name == "" {
+		return "<fn>()"
+	}
+	return function.Name + "()"
+}
+
+// printing guards against lists and maps that contain themselves.
+var printing = make(map[Object]bool)
+
+func writeList(builder *strings.Builder, list *ObjList) {
+	if printing[list] {
+		builder.WriteString("[...]")
+		return
+	}
+	printing[list] = true
+	builder.WriteString("[")
+	for i, item := range list.Items {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		writeValue(builder, item)
 	}
+	builder.WriteString("]")
+	delete(printing, list)
+}
+
+func writeMap(builder *strings.Builder, m *ObjMap) {
+	if printing[m] {
+		builder.WriteString("{...}")
+		return
+	}
+	printing[m] = true
+	builder.WriteString("{")
+	first := true
+	for _, entry := range m.entries {
+		if entry.removed {
+			continue
+		}
+		if !first {
+			builder.WriteString(", ")
+		}
+		first = false
+		writeValue(builder, entry.key)
+		builder.WriteString(": ")
+		writeValue(builder, entry.value)
+	}
+	builder.WriteString("}")
+	delete(printing, m)
 }
 
 func printValues(value Value) {
 	PrintValue(value)
 }
+
+var regOpNames = map[uint8]string{
+	ROP_MOVE:          "ROP_MOVE",
+	ROP_GET_GLOBAL:    "ROP_GET_GLOBAL",
+	ROP_DEFINE_GLOBAL: "ROP_DEFINE_GLOBAL",
+	ROP_DEFINE_CONST:  "ROP_DEFINE_CONST",
+	ROP_SET_GLOBAL:    "ROP_SET_GLOBAL",
+	ROP_EQUAL:         "ROP_EQUAL",
+	ROP_GREATER:       "ROP_GREATER",
+	ROP_LESS:          "ROP_LESS",
+	ROP_ADD:           "ROP_ADD",
+	ROP_SUBTRACT:      "ROP_SUBTRACT",
+	ROP_MULTIPLY:      "ROP_MULTIPLY",
+	ROP_DIVIDE:        "ROP_DIVIDE",
+	ROP_INT_DIVIDE:    "ROP_INT_DIVIDE",
+	ROP_MODULO:        "ROP_MODULO",
+	ROP_POWER:         "ROP_POWER",
+	ROP_BIT_AND:       "ROP_BIT_AND",
+	ROP_BIT_OR:        "ROP_BIT_OR",
+	ROP_BIT_XOR:       "ROP_BIT_XOR",
+	ROP_SHIFT_LEFT:    "ROP_SHIFT_LEFT",
+	ROP_SHIFT_RIGHT:   "ROP_SHIFT_RIGHT",
+	ROP_BIT_NOT:       "ROP_BIT_NOT",
+	ROP_TO_STRING:     "ROP_TO_STRING",
+	ROP_NOT:           "ROP_NOT",
+	ROP_NEGATE:        "ROP_NEGATE",
+	ROP_BUILD_LIST:    "ROP_BUILD_LIST",
+	ROP_BUILD_MAP:     "ROP_BUILD_MAP",
+	ROP_GET_INDEX:     "ROP_GET_INDEX",
+	ROP_SET_INDEX:     "ROP_SET_INDEX",
+	ROP_GET_PROPERTY:  "ROP_GET_PROPERTY",
+	ROP_INVOKE:        "ROP_INVOKE",
+	ROP_PRINT:         "ROP_PRINT",
+	ROP_JUMP:          "ROP_JUMP",
+	ROP_JUMP_IF_FALSE: "ROP_JUMP_IF_FALSE",
+	ROP_SKIP_DEFAULT:  "ROP_SKIP_DEFAULT",
+	ROP_FOR_ITER:      "ROP_FOR_ITER",
+	ROP_GET_UPVALUE:   "ROP_GET_UPVALUE",
+	ROP_SET_UPVALUE:   "ROP_SET_UPVALUE",
+	ROP_CALL:          "ROP_CALL",
+	ROP_SPAWN:         "ROP_SPAWN",
+	ROP_CALL_NAMED:    "ROP_CALL_NAMED",
+	ROP_EXTEND:        "ROP_EXTEND",
+	ROP_CALL_SPREAD:   "ROP_CALL_SPREAD",
+	ROP_SPAWN_NAMED:   "ROP_SPAWN_NAMED",
+	ROP_SPAWN_SPREAD:  "ROP_SPAWN_SPREAD",
+	ROP_CLOSURE:       "ROP_CLOSURE",
+	ROP_CLOSE_UPVALUE: "ROP_CLOSE_UPVALUE",
+	ROP_IMPORT:        "ROP_IMPORT",
+	ROP_THROW:         "ROP_THROW",
+	ROP_YIELD:         "ROP_YIELD",
+	ROP_RETURN:        "ROP_RETURN",
+}
+
+func (chunk *RegChunk) DisassembleRegChunk(name string) {
+	fmt.Printf("== %s (registers) ==\n", name)
+	captures := 0
+	for pc, instruction := range chunk.Code {
+		if captures > 0 {
+			// The words after a ROP_CLOSURE say what each upvalue captures.
+			kind := "upvalue"
+			if instruction.A() == 1 {
+				kind = "local"
+			}
+			fmt.Printf("%04d    |                       %s %d\n", pc, kind, instruction.B())
+			captures--
+			continue
+		}
+		fmt.Printf("%04d ", pc)
+		if pc > 0 && chunk.GetLine(pc) == chunk.GetLine(pc-1) {
+			fmt.Printf("   | ")
+		} else {
+			fmt.Printf("%4d ", chunk.GetLine(pc))
+		}
+		switch instruction.Op() {
+		case ROP_JUMP, ROP_JUMP_IF_FALSE, ROP_SKIP_DEFAULT, ROP_FOR_ITER:
+			fmt.Printf("%-18s r%d -> %d\n", regOpNames[instruction.Op()], instruction.A(), instruction.J())
+		case ROP_CALL_NAMED, ROP_SPAWN_NAMED:
+			fmt.Printf("%-18s r%d %d k%d\n", regOpNames[instruction.Op()], instruction.A(), instruction.B(), instruction.C())
+		case ROP_CALL_SPREAD, ROP_SPAWN_SPREAD, ROP_IMPORT:
+			fmt.Printf("%-18s r%d k%d\n", regOpNames[instruction.Op()], instruction.A(), instruction.B())
+		case ROP_GET_PROPERTY:
+			fmt.Printf("%-18s r%d %s k%d\n", "ROP_GET_PROPERTY", instruction.A(),
+				chunk.rkString(instruction.B()), instruction.C())
+		case ROP_CLOSURE:
+			function := AsFunction(chunk.Constants[instruction.B()])
+			fmt.Printf("%-18s r%d k%d %s\n", "ROP_CLOSURE", instruction.A(), instruction.B(), toString(ObjVal(function)))
+			captures = function.UpvalueCount
+		default:
+			fmt.Printf("%-18s r%d %s %s\n", regOpNames[instruction.Op()], instruction.A(),
+				chunk.rkString(instruction.B()), chunk.rkString(instruction.C()))
+		}
+	}
+	disassembleHandlers(chunk.Handlers)
+}
+
+func (chunk *RegChunk) rkString(operand int) string {
+	if operand&RK_CONSTANT != 0 {
+		return fmt.Sprintf("k%d", operand&^RK_CONSTANT)
+	}
+	return fmt.Sprintf("r%d", operand)
+}
@@ -37,6 +37,7 @@ func repl(v *VM) {
 
 func runFile(v *VM, path string) {
 	source := readFile(path)
+	v.SetScriptPath(path)
 	result := v.Interpret(source)
 
 	switch result {
@@ -1,14 +1,475 @@
 package main
 
+import "unique"
+
 type ObjType int
 
 const (
+	OBJ_STRING ObjType = iota
+	OBJ_LIST
+	OBJ_MAP
+	OBJ_FUNCTION
+	OBJ_NATIVE
+	OBJ_CLOSURE
+	OBJ_UPVALUE
+	OBJ_ERROR
+	OBJ_MODULE
+	OBJ_RANGE
+	OBJ_GENERATOR
+	OBJ_FIBER
+	OBJ_THREAD
+	OBJ_CHANNEL
 )
 
 type Obj struct {
 	Type ObjType
 }
 
+// Object is satisfied by every heap object through its embedded Obj.
+type Object interface {
+	header() *Obj
+}
+
+func (obj *Obj) header() *Obj {
+	return obj
+}
+
 func IsObjType(value Value, Type ObjType) bool {
 	return IsObj(value) && AsObj(value).Type == Type
 }
+
+// ObjString is a string produced by concatenation. Its bytes live in a
+// buffer that later concatenations extend in place, so a loop that keeps
+// appending to the same string copies each piece once instead of copying
+// the whole string on every step. Only the string that ends where the
+// buffer ends may extend it, so every ObjString sharing a buffer keeps
+// seeing its own prefix unchanged.
+//
+// Observing the string flattens it and interns the text, so equal strings
+// share their storage and compare by handle. The intern table only holds
+// a text while some string's handle to it is alive.
+type ObjString struct {
+	Obj
+	buffer *stringBuffer
+	length int
+	handle unique.Handle[string]
+	flat   bool
+}
+
+type stringBuffer struct {
+	bytes []byte
+}
+
+func newString(buffer *stringBuffer) *ObjString {
+	return &ObjString{Obj: Obj{Type: OBJ_STRING}, buffer: buffer, length: len(buffer.bytes)}
+}
+
+// text flattens and interns the string the first time it is observed.
+func (str *ObjString) text() string {
+	if !str.flat {
+		str.handle = unique.Make(string(str.buffer.bytes[:str.length]))
+		str.flat = true
+	}
+	return str.handle.Value()
+}
+
+// contents is the string's bytes without flattening it. Later appends to
+// the buffer never touch them, so they stay valid, but they must not be
+// modified.
+func (str *ObjString) contents() []byte {
+	return str.buffer.bytes[:str.length]
+}
+
+func AsObjString(value Value) *ObjString {
+	return value.obj.(*ObjString)
+}
+
+func appendString(bytes []byte, value Value) []byte {
+	if IsObjType(value, OBJ_STRING) {
+		str := AsObjString(value)
+		return append(bytes, str.buffer.bytes[:str.length]...)
+	}
+	return append(bytes, value.String...)
+}
+
+func concatenate(a Value, b Value) Value {
+	if IsObjType(a, OBJ_STRING) {
+		left := AsObjString(a)
+		if len(left.buffer.bytes) == left.length {
+			left.buffer.bytes = appendString(left.buffer.bytes, b)
+			return ObjVal(newString(left.buffer))
+		}
+	}
+	buffer := &stringBuffer{}
+	buffer.bytes = appendString(buffer.bytes, a)
+	buffer.bytes = appendString(buffer.bytes, b)
+	return ObjVal(newString(buffer))
+}
+
+type ObjList struct {
+	Obj
+	Items []Value
+}
+
+func newList(items []Value) *ObjList {
+	return &ObjList{Obj: Obj{Type: OBJ_LIST}, Items: items}
+}
+
+func AsList(value Value) *ObjList {
+	return value.obj.(*ObjList)
+}
+
+// ObjMap keeps its entries in insertion order, which is the order keys()
+// and values() report them in. Removing a key leaves its entry behind as
+// a tombstone, so the others keep their places; once tombstones make up
+// half the entries, they are compacted away.
+type ObjMap struct {
+	Obj
+	entries []mapEntry
+	index   map[HashKey]int
+	removed int
+}
+
+type mapEntry struct {
+	key     Value
+	value   Value
+	removed bool
+}
+
+func newMap() *ObjMap {
+	return &ObjMap{Obj: Obj{Type: OBJ_MAP}, index: make(map[HashKey]int)}
+}
+
+func AsMap(value Value) *ObjMap {
+	return value.obj.(*ObjMap)
+}
+
+func (m *ObjMap) get(key HashKey) (Value, bool) {
+	if i, ok := m.index[key]; ok {
+		return m.entries[i].value, true
+	}
+	return NilVal(), false
+}
+
+func (m *ObjMap) set(key HashKey, keyValue Value, value Value) {
+	if i, ok := m.index[key]; ok {
+		m.entries[i].value = value
+		return
+	}
+	m.index[key] = len(m.entries)
+	m.entries = append(m.entries, mapEntry{key: keyValue, value: value})
+}
+
+func (m *ObjMap) remove(key HashKey) (Value, bool) {
+	i, ok := m.index[key]
+	if !ok {
+		return NilVal(), false
+	}
+	value := m.entries[i].value
+	m.entries[i] = mapEntry{key: NilVal(), value: NilVal(), removed: true}
+	delete(m.index, key)
+	m.removed++
+	if m.removed > len(m.entries)/2 {
+		m.compact()
+	}
+	return value, true
+}
+
+// compact drops the tombstones, moving the entries after each one down.
+func (m *ObjMap) compact() {
+	moved := make([]int, len(m.entries))
+	live := m.entries[:0]
+	for i, entry := range m.entries {
+		if !entry.removed {
+			moved[i] = len(live)
+			live = append(live, entry)
+		}
+	}
+	for key, i := range m.index {
+		m.index[key] = moved[i]
+	}
+	clear(m.entries[len(live):])
+	m.entries = live
+	m.removed = 0
+}
+
+func (m *ObjMap) len() int {
+	return len(m.entries) - m.removed
+}
+
+func (m *ObjMap) keys() []Value {
+	keys := make([]Value, 0, m.len())
+	for _, entry := range m.entries {
+		if !entry.removed {
+			keys = append(keys, entry.key)
+		}
+	}
+	return keys
+}
+
+func (m *ObjMap) values() []Value {
+	values := make([]Value, 0, m.len())
+	for _, entry := range m.entries {
+		if !entry.removed {
+			values = append(values, entry.value)
+		}
+	}
+	return values
+}
+
+// ObjFunction is a compiled function body. Name is empty for the top-level
+// script and for anonymous functions. Params names each of the Arity
+// parameters for keyword arguments; the first Required have no default.
+// A Variadic function's last parameter is the list of surplus arguments.
+type ObjFunction struct {
+	Obj
+	Arity        int
+	Required     int
+	Params       []string
+	Variadic     bool
+	Generator    bool // whether calling it makes a generator
+	UpvalueCount int
+	Chunk        Chunk
+	Name         string
+	// Module is the module whose globals the function's code uses.
+	Module *ObjModule
+	// Registers is the register translation of Chunk, made the first time
+	// the register backend calls the function.
+	Registers *RegChunk
+}
+
+func newFunction() *ObjFunction {
+	function := &ObjFunction{Obj: Obj{Type: OBJ_FUNCTION}}
+	function.Chunk.InitChunk()
+	return function
+}
+
+func AsFunction(value Value) *ObjFunction {
+	return value.obj.(*ObjFunction)
+}
+
+// NativeFn receives its arguments as a slice of the VM stack. It returns
+// false after reporting a runtime error.
+type NativeFn func(vm *VM, args []Value) (Value, bool)
+
+type ObjNative struct {
+	Obj
+	Name  string
+	Arity int
+	Fn    NativeFn
+}
+
+func newNative(name string, arity int, fn NativeFn) *ObjNative {
+	return &ObjNative{Obj: Obj{Type: OBJ_NATIVE}, Name: name, Arity: arity, Fn: fn}
+}
+
+func AsNative(value Value) *ObjNative {
+	return value.obj.(*ObjNative)
+}
+
+// ObjClosure is a function together with the variables it captured.
+type ObjClosure struct {
+	Obj
+	Function *ObjFunction
+	Upvalues []*ObjUpvalue
+}
+
+func newClosure(function *ObjFunction) *ObjClosure {
+	return &ObjClosure{
+		Obj:      Obj{Type: OBJ_CLOSURE},
+		Function: function,
+		Upvalues: make([]*ObjUpvalue, function.UpvalueCount),
+	}
+}
+
+func AsClosure(value Value) *ObjClosure {
+	return value.obj.(*ObjClosure)
+}
+
+// ObjUpvalue is a captured variable. While the variable's stack slot is
+// live, Location points at it; once the slot is popped the value moves
+// into Closed and Location points there instead. Open upvalues form a list
+// sorted by Slot, highest first, so closures capturing the same variable
+// share one upvalue.
+type ObjUpvalue struct {
+	Obj
+	Location *Value
+	Closed   Value
+	Slot     int
+	Next     *ObjUpvalue
+}
+
+func newUpvalue(slot *Value, index int) *ObjUpvalue {
+	return &ObjUpvalue{Obj: Obj{Type: OBJ_UPVALUE}, Location: slot, Slot: index}
+}
+
+// ObjError is what a runtime error throws, carrying its message and the
+// stack trace from where it happened.
+type ObjError struct {
+	Obj
+	Message string
+	Trace   []string
+}
+
+func newError(message string, trace []string) *ObjError {
+	return &ObjError{Obj: Obj{Type: OBJ_ERROR}, Message: message, Trace: trace}
+}
+
+func AsError(value Value) *ObjError {
+	return value.obj.(*ObjError)
+}
+
+// ObjModule is a source file's global namespace. Script is the function
+// for its top-level code, and Loaded turns true once that has returned.
+// Only the names in Exports can be reached from other modules.
+type ObjModule struct {
+	Obj
+	Name    string // the path as the import wrote it
+	Path    string // the path resolved against the importing file
+	Globals map[string]Value
+	Exports map[string]bool
+	// Constants are the globals declared with const.
+	Constants map[string]bool
+	Script    *ObjFunction
+	Loaded    bool
+}
+
+func newModule(name string, path string) *ObjModule {
+	module := &ObjModule{
+		Obj:       Obj{Type: OBJ_MODULE},
+		Name:      name,
+		Path:      path,
+		Globals:   make(map[string]Value),
+		Exports:   make(map[string]bool),
+		Constants: make(map[string]bool),
+	}
+	defineNatives(module.Globals)
+	return module
+}
+
+func AsModule(value Value) *ObjModule {
+	return value.obj.(*ObjModule)
+}
+
+// ObjRange is the numbers from Start up to but not including End.
+type ObjRange struct {
+	Obj
+	Start float64
+	End   float64
+}
+
+func newRange(start float64, end float64) *ObjRange {
+	return &ObjRange{Obj: Obj{Type: OBJ_RANGE}, Start: start, End: end}
+}
+
+func AsRange(value Value) *ObjRange {
+	return value.obj.(*ObjRange)
+}
+
+type GeneratorState int
+
+const (
+	GENERATOR_SUSPENDED GeneratorState = iota
+	GENERATOR_RUNNING
+	GENERATOR_DONE
+)
+
+// ObjGenerator is a call to a function containing yield, which runs only
+// as far as its next yield each time it is resumed. While it is suspended
+// Stack holds its frame's slots, Ip where it carries on, and Upvalues the
+// open upvalues pointing into Stack, with their Slot relative to it.
+type ObjGenerator struct {
+	Obj
+	Closure  *ObjClosure
+	Stack    []Value
+	Ip       int
+	Upvalues []*ObjUpvalue
+	State    GeneratorState
+}
+
+func newGenerator(closure *ObjClosure, stack []Value) *ObjGenerator {
+	return &ObjGenerator{Obj: Obj{Type: OBJ_GENERATOR}, Closure: closure, Stack: stack}
+}
+
+func AsGenerator(value Value) *ObjGenerator {
+	return value.obj.(*ObjGenerator)
+}
+
+type FiberState int
+
+const (
+	FIBER_NEW FiberState = iota
+	FIBER_SUSPENDED
+	// FIBER_RUNNING is the running fiber and those waiting on a fiber they
+	// called.
+	FIBER_RUNNING
+	FIBER_DONE
+)
+
+// ObjFiber is a fiber as a value: its own stacks, and how it was switched
+// to. A new fiber runs Closure. The root fiber, which the script starts in,
+// has none.
+type ObjFiber struct {
+	Obj
+	Fiber
+	Closure *ObjClosure
+	State   FiberState
+	// Caller is the fiber to go back to when this one yields or finishes.
+	// Trying is set when Caller used try() and wants errors handed back.
+	Caller *ObjFiber
+	Trying bool
+	// Result is the slot that gets the value the fiber is next resumed
+	// with, the result of the call that switched away from it.
+	Result int
+	// Error is what the fiber threw that nothing caught, or nil.
+	Error Value
+}
+
+func newFiber(closure *ObjClosure) *ObjFiber {
+	fiber := &ObjFiber{Obj: Obj{Type: OBJ_FIBER}, Closure: closure, Error: NilVal()}
+	fiber.Stack = make([]Value, FRAME_SLOTS)
+	return fiber
+}
+
+func AsFiber(value Value) *ObjFiber {
+	return value.obj.(*ObjFiber)
+}
+
+// ObjThread is a call spawned on a goroutine of its own. Once Done,
+// Result is what the call returned. Joiners are the threads waiting for
+// it to finish.
+type ObjThread struct {
+	Obj
+	Done    bool
+	Result  Value
+	Joiners []*Waiter
+}
+
+func newThread() *ObjThread {
+	return &ObjThread{Obj: Obj{Type: OBJ_THREAD}, Result: NilVal()}
+}
+
+func AsThread(value Value) *ObjThread {
+	return value.obj.(*ObjThread)
+}
+
+// ObjChannel passes values between threads. Values sent wait in Buffer,
+// up to Capacity of them; beyond that senders wait their turn, as do
+// receivers while there is nothing to receive. It is only read or written
+// holding the scheduler's lock.
+type ObjChannel struct {
+	Obj
+	Capacity  int
+	Buffer    []Value
+	Closed    bool
+	Senders   []*Waiter
+	Receivers []*Waiter
+}
+
+func newChannel(capacity int) *ObjChannel {
+	return &ObjChannel{Obj: Obj{Type: OBJ_CHANNEL}, Capacity: capacity}
+}
+
+func AsChannel(value Value) *ObjChannel {
+	return value.obj.(*ObjChannel)
+}
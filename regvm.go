@@ -0,0 +1,970 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// The register backend shares the scanner and compiler with the stack
+// machine. Compile still emits stack bytecode; translateFunction then
+// rewrites each function, the first time it is called, into three-address
+// instructions whose registers are the very stack slots the stack machine
+// would have used, so locals keep the slot the compiler gave them and
+// temporaries live above them. Register 0 is the frame's callee, as slot 0
+// is on the stack machine.
+
+const (
+	ROP_MOVE = iota
+	ROP_GET_GLOBAL
+	ROP_DEFINE_GLOBAL
+	ROP_DEFINE_CONST
+	ROP_SET_GLOBAL
+	ROP_EQUAL
+	ROP_GREATER
+	ROP_LESS
+	ROP_ADD
+	ROP_SUBTRACT
+	ROP_MULTIPLY
+	ROP_DIVIDE
+	ROP_INT_DIVIDE
+	ROP_MODULO
+	ROP_POWER
+	ROP_BIT_AND
+	ROP_BIT_OR
+	ROP_BIT_XOR
+	ROP_SHIFT_LEFT
+	ROP_SHIFT_RIGHT
+	ROP_BIT_NOT
+	ROP_TO_STRING
+	ROP_NOT
+	ROP_NEGATE
+	ROP_BUILD_LIST
+	ROP_BUILD_MAP
+	ROP_GET_INDEX
+	ROP_SET_INDEX
+	ROP_GET_PROPERTY
+	ROP_INVOKE
+	ROP_PRINT
+	ROP_JUMP
+	ROP_JUMP_IF_FALSE
+	ROP_SKIP_DEFAULT
+	ROP_FOR_ITER
+	ROP_GET_UPVALUE
+	ROP_SET_UPVALUE
+	ROP_CALL
+	ROP_SPAWN
+	ROP_CALL_NAMED
+	ROP_EXTEND
+	ROP_CALL_SPREAD
+	ROP_SPAWN_NAMED
+	ROP_SPAWN_SPREAD
+	ROP_CLOSURE
+	ROP_CLOSE_UPVALUE
+	ROP_IMPORT
+	ROP_THROW
+	ROP_YIELD
+	ROP_RETURN
+)
+
+// RK_CONSTANT marks a B or C operand that names a constant rather than a
+// register.
+const RK_CONSTANT = 0x8000
+
+// RegInstruction packs an opcode and up to three 16-bit operands:
+//
+//	bits  0-7   opcode
+//	bits  8-23  A (usually the destination register)
+//	bits 24-39  B
+//	bits 40-55  C
+//
+// Jumps keep their absolute target in the 32 bits B and C share.
+type RegInstruction uint64
+
+func regABC(op int, a, b, c int) RegInstruction {
+	return RegInstruction(op) | RegInstruction(a)<<8 | RegInstruction(b)<<24 | RegInstruction(c)<<40
+}
+
+func regAJ(op int, a, target int) RegInstruction {
+	return RegInstruction(op) | RegInstruction(a)<<8 | RegInstruction(uint32(target))<<24
+}
+
+func (i RegInstruction) Op() uint8 { return uint8(i) }
+func (i RegInstruction) A() int    { return int(uint16(i >> 8)) }
+func (i RegInstruction) B() int    { return int(uint16(i >> 24)) }
+func (i RegInstruction) C() int    { return int(uint16(i >> 40)) }
+func (i RegInstruction) J() int    { return int(uint32(i >> 24)) }
+
+type RegChunk struct {
+	Code      []RegInstruction
+	Lines     LineTable
+	Constants []Value
+	Handlers  []Handler // as in the stack chunk, with register pcs
+}
+
+func (chunk *RegChunk) GetLine(pc int) int {
+	return chunk.Lines.line(pc)
+}
+
+type operandKind int
+
+const (
+	OPERAND_SLOT     operandKind = iota // the value sits in its own stack slot
+	OPERAND_LOCAL                       // a local not yet copied into this slot
+	OPERAND_CONSTANT                    // a constant not yet loaded into this slot
+)
+
+type operand struct {
+	kind  operandKind
+	index int
+}
+
+type regTranslator struct {
+	chunk   *Chunk
+	out     *RegChunk
+	stack   []operand
+	line    int
+	column  int
+	depths  []int        // stack offset -> depth on entry, -1 if unreachable
+	labels  map[int]bool // stack offsets some jump lands on
+	starts  map[int]int  // stack offset -> register pc
+	patches map[int]int  // register pc -> stack offset it jumps to
+	// produced is the pc of the instruction that just wrote the top of the
+	// stack into its own slot, or -1. SET_LOCAL retargets it when it can.
+	produced int
+	literals map[Value]int
+	// reachable is false when the previous instruction never falls through.
+	reachable bool
+}
+
+func stackInstructionLength(chunk *Chunk, offset int) int {
+	switch chunk.Code[offset] {
+	case OP_CONSTANT, OP_GET_LOCAL, OP_SET_LOCAL, OP_BURY, OP_GET_GLOBAL,
+		OP_DEFINE_GLOBAL, OP_DEFINE_CONST, OP_SET_GLOBAL, OP_GET_UPVALUE, OP_SET_UPVALUE,
+		OP_BUILD_LIST, OP_BUILD_MAP, OP_GET_PROPERTY, OP_CALL, OP_SPAWN, OP_CALL_SPREAD,
+		OP_SPAWN_SPREAD, OP_IMPORT:
+		return 2
+	case OP_CLOSURE:
+		function := AsFunction(chunk.Constants[chunk.Code[offset+1]])
+		return 2 + 2*function.UpvalueCount
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_LOOP, OP_INVOKE, OP_CALL_NAMED, OP_SPAWN_NAMED:
+		return 3
+	case OP_SKIP_DEFAULT, OP_FOR_ITER:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// stackEffect is the number of values an instruction pushes minus the
+// number it pops.
+func stackEffect(chunk *Chunk, offset int) int {
+	switch chunk.Code[offset] {
+	case OP_CONSTANT, OP_NIL, OP_TRUE, OP_FALSE, OP_GET_LOCAL, OP_GET_GLOBAL,
+		OP_GET_UPVALUE, OP_DUP, OP_CLOSURE, OP_IMPORT, OP_FOR_ITER:
+		return 1
+	case OP_DUP2:
+		return 2
+	case OP_POP, OP_DEFINE_GLOBAL, OP_DEFINE_CONST, OP_EQUAL, OP_GREATER, OP_LESS,
+		OP_ADD, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE, OP_INT_DIVIDE, OP_MODULO,
+		OP_POWER, OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR, OP_SHIFT_LEFT, OP_SHIFT_RIGHT,
+		OP_GET_INDEX, OP_PRINT, OP_CLOSE_UPVALUE, OP_THROW, OP_YIELD, OP_RETURN, OP_EXTEND:
+		return -1
+	case OP_SET_INDEX:
+		return -2
+	case OP_BUILD_LIST:
+		return 1 - int(chunk.Code[offset+1])
+	case OP_BUILD_MAP:
+		return 1 - 2*int(chunk.Code[offset+1])
+	case OP_INVOKE:
+		return -int(chunk.Code[offset+2])
+	case OP_CALL, OP_SPAWN, OP_CALL_NAMED, OP_SPAWN_NAMED:
+		return -int(chunk.Code[offset+1])
+	case OP_CALL_SPREAD, OP_SPAWN_SPREAD:
+		// The callee, the argument list and the keyword arguments.
+		names := AsList(chunk.Constants[chunk.Code[offset+1]])
+		return -1 - len(names.Items)
+	default:
+		return 0
+	}
+}
+
+// stackDepths finds the stack depth on entry to every instruction by
+// following both sides of each jump. The function starts with entry slots
+// in use, its callee and parameters, and each exception handler with the
+// exception above the slots it keeps. Offsets no path reaches stay -1.
+func stackDepths(chunk *Chunk, entry int) []int {
+	depths := make([]int, len(chunk.Code))
+	for i := range depths {
+		depths[i] = -1
+	}
+	depths[0] = entry
+	work := []int{0}
+	for _, handler := range chunk.Handlers {
+		depths[handler.Target] = handler.Depth + 1
+		work = append(work, handler.Target)
+	}
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		instruction := chunk.Code[offset]
+		depth := depths[offset] + stackEffect(chunk, offset)
+		next := offset + stackInstructionLength(chunk, offset)
+		var successors []int
+		switch instruction {
+		case OP_JUMP:
+			successors = []int{next + chunk.readShort(offset+1)}
+		case OP_JUMP_IF_FALSE:
+			successors = []int{next, next + chunk.readShort(offset+1)}
+		case OP_SKIP_DEFAULT, OP_FOR_ITER:
+			successors = []int{next, next + chunk.readShort(offset+2)}
+		case OP_LOOP:
+			successors = []int{next - chunk.readShort(offset+1)}
+		case OP_RETURN, OP_THROW:
+		default:
+			successors = []int{next}
+		}
+		for _, successor := range successors {
+			if successor < len(chunk.Code) && depths[successor] == -1 {
+				depths[successor] = depth
+				work = append(work, successor)
+			}
+		}
+	}
+	return depths
+}
+
+// registers returns the register translation of function, translating it
+// the first time.
+func (function *ObjFunction) registers() *RegChunk {
+	if function.Registers == nil {
+		function.Registers = translateFunction(function)
+	}
+	return function.Registers
+}
+
+func translateFunction(function *ObjFunction) *RegChunk {
+	chunk := &function.Chunk
+	entry := function.Arity + 1
+	t := &regTranslator{
+		chunk:     chunk,
+		out:       &RegChunk{Constants: append([]Value{}, chunk.Constants...)},
+		depths:    stackDepths(chunk, entry),
+		labels:    make(map[int]bool),
+		starts:    make(map[int]int),
+		patches:   make(map[int]int),
+		produced:  -1,
+		literals:  make(map[Value]int),
+		reachable: true,
+	}
+
+	t.resetTo(entry)
+	// A handler needs the slots it keeps to be in place when anything in
+	// its range throws, so its start flushes pending values into them.
+	for _, handler := range chunk.Handlers {
+		t.labels[handler.Start] = true
+		t.labels[handler.Target] = true
+	}
+
+	for offset := 0; offset < len(chunk.Code); offset += stackInstructionLength(chunk, offset) {
+		switch chunk.Code[offset] {
+		case OP_JUMP, OP_JUMP_IF_FALSE:
+			t.labels[offset+3+chunk.readShort(offset+1)] = true
+		case OP_LOOP:
+			t.labels[offset+3-chunk.readShort(offset+1)] = true
+		case OP_SKIP_DEFAULT, OP_FOR_ITER:
+			t.labels[offset+4+chunk.readShort(offset+2)] = true
+		}
+	}
+
+	for offset := 0; offset < len(chunk.Code); {
+		offset = t.translateInstruction(offset)
+	}
+	t.starts[len(chunk.Code)] = len(t.out.Code)
+
+	for pc, target := range t.patches {
+		t.out.Code[pc] = regAJ(int(t.out.Code[pc].Op()), t.out.Code[pc].A(), t.starts[target])
+	}
+	for _, handler := range chunk.Handlers {
+		t.out.Handlers = append(t.out.Handlers, Handler{
+			Start:  t.starts[handler.Start],
+			End:    t.starts[handler.End],
+			Target: t.starts[handler.Target],
+			Depth:  handler.Depth,
+		})
+	}
+	return t.out
+}
+
+func (chunk *Chunk) readShort(offset int) int {
+	return int(chunk.Code[offset])<<8 | int(chunk.Code[offset+1])
+}
+
+func (t *regTranslator) translateInstruction(offset int) int {
+	instruction := t.chunk.Code[offset]
+	if t.depths[offset] == -1 {
+		// Dead code, such as whatever follows a break.
+		t.starts[offset] = len(t.out.Code)
+		t.reachable = false
+		return offset + stackInstructionLength(t.chunk, offset)
+	}
+	if t.labels[offset] {
+		if t.reachable {
+			t.flush()
+		}
+		t.resetTo(t.depths[offset])
+	}
+	t.starts[offset] = len(t.out.Code)
+	t.reachable = true
+	t.line = t.chunk.GetLine(offset)
+	t.column = t.chunk.GetColumn(offset)
+
+	switch instruction {
+	case OP_CONSTANT:
+		t.push(operand{OPERAND_CONSTANT, int(t.chunk.Code[offset+1])})
+	case OP_NIL:
+		t.push(operand{OPERAND_CONSTANT, t.literal(NilVal())})
+	case OP_TRUE:
+		t.push(operand{OPERAND_CONSTANT, t.literal(BoolVal(true))})
+	case OP_FALSE:
+		t.push(operand{OPERAND_CONSTANT, t.literal(BoolVal(false))})
+	case OP_POP:
+		t.pop()
+	case OP_DUP:
+		t.push(t.peek())
+	case OP_DUP2:
+		n := len(t.stack)
+		t.push(t.stack[n-2])
+		t.push(t.stack[n-1])
+	case OP_BURY:
+		t.bury(int(t.chunk.Code[offset+1]))
+	case OP_GET_LOCAL:
+		slot := int(t.chunk.Code[offset+1])
+		if slot < len(t.stack) {
+			t.materialize(slot)
+		}
+		t.push(operand{OPERAND_LOCAL, slot})
+	case OP_SET_LOCAL:
+		t.setLocal(int(t.chunk.Code[offset+1]))
+	case OP_GET_GLOBAL:
+		t.produce(ROP_GET_GLOBAL, int(t.chunk.Code[offset+1]), 0)
+	case OP_DEFINE_GLOBAL:
+		value := t.rk(t.pop())
+		t.emit(regABC(ROP_DEFINE_GLOBAL, int(t.chunk.Code[offset+1]), value, 0))
+	case OP_DEFINE_CONST:
+		value := t.rk(t.pop())
+		t.emit(regABC(ROP_DEFINE_CONST, int(t.chunk.Code[offset+1]), value, 0))
+	case OP_SET_GLOBAL:
+		value := t.rk(t.peek())
+		t.emit(regABC(ROP_SET_GLOBAL, int(t.chunk.Code[offset+1]), value, 0))
+	case OP_GET_UPVALUE:
+		t.produce(ROP_GET_UPVALUE, int(t.chunk.Code[offset+1]), 0)
+	case OP_SET_UPVALUE:
+		value := t.rk(t.peek())
+		t.emit(regABC(ROP_SET_UPVALUE, int(t.chunk.Code[offset+1]), value, 0))
+	case OP_EQUAL:
+		t.binary(ROP_EQUAL)
+	case OP_GREATER:
+		t.binary(ROP_GREATER)
+	case OP_LESS:
+		t.binary(ROP_LESS)
+	case OP_ADD:
+		t.binary(ROP_ADD)
+	case OP_SUBTRACT:
+		t.binary(ROP_SUBTRACT)
+	case OP_MULTIPLY:
+		t.binary(ROP_MULTIPLY)
+	case OP_DIVIDE:
+		t.binary(ROP_DIVIDE)
+	case OP_INT_DIVIDE:
+		t.binary(ROP_INT_DIVIDE)
+	case OP_MODULO:
+		t.binary(ROP_MODULO)
+	case OP_POWER:
+		t.binary(ROP_POWER)
+	case OP_BIT_AND:
+		t.binary(ROP_BIT_AND)
+	case OP_BIT_OR:
+		t.binary(ROP_BIT_OR)
+	case OP_BIT_XOR:
+		t.binary(ROP_BIT_XOR)
+	case OP_SHIFT_LEFT:
+		t.binary(ROP_SHIFT_LEFT)
+	case OP_SHIFT_RIGHT:
+		t.binary(ROP_SHIFT_RIGHT)
+	case OP_BIT_NOT:
+		t.produce(ROP_BIT_NOT, t.rk(t.pop()), 0)
+	case OP_TO_STRING:
+		t.produce(ROP_TO_STRING, t.rk(t.pop()), 0)
+	case OP_NOT:
+		t.produce(ROP_NOT, t.rk(t.pop()), 0)
+	case OP_NEGATE:
+		t.produce(ROP_NEGATE, t.rk(t.pop()), 0)
+	case OP_BUILD_LIST:
+		count := int(t.chunk.Code[offset+1])
+		t.materializeTop(count)
+		t.stack = t.stack[:len(t.stack)-count]
+		t.produce(ROP_BUILD_LIST, count, 0)
+	case OP_BUILD_MAP:
+		count := 2 * int(t.chunk.Code[offset+1])
+		t.materializeTop(count)
+		t.stack = t.stack[:len(t.stack)-count]
+		t.produce(ROP_BUILD_MAP, count, 0)
+	case OP_GET_INDEX:
+		t.binary(ROP_GET_INDEX)
+	case OP_SET_INDEX:
+		value := t.pop()
+		index := t.rk(t.pop())
+		list := t.rk(t.pop())
+		t.emit(regABC(ROP_SET_INDEX, list, index, t.rk(value)))
+		if value.kind == OPERAND_SLOT {
+			t.produce(ROP_MOVE, value.index, 0)
+		} else {
+			t.push(value)
+		}
+	case OP_GET_PROPERTY:
+		t.produce(ROP_GET_PROPERTY, t.rk(t.pop()), int(t.chunk.Code[offset+1]))
+	case OP_INVOKE:
+		// A function a module exports runs in a frame at the receiver's
+		// register, so this flushes as OP_CALL does.
+		argCount := int(t.chunk.Code[offset+2])
+		t.flush()
+		t.stack = t.stack[:len(t.stack)-argCount-1]
+		t.produce(ROP_INVOKE, int(t.chunk.Code[offset+1]), argCount)
+		t.produced = -1
+	case OP_PRINT:
+		t.emit(regABC(ROP_PRINT, 0, t.rk(t.pop()), 0))
+	case OP_JUMP:
+		t.jump(ROP_JUMP, 0, offset+3+t.chunk.readShort(offset+1))
+		t.reachable = false
+	case OP_JUMP_IF_FALSE:
+		t.flush()
+		t.jump(ROP_JUMP_IF_FALSE, len(t.stack)-1, offset+3+t.chunk.readShort(offset+1))
+	case OP_LOOP:
+		t.jump(ROP_JUMP, 0, offset+3-t.chunk.readShort(offset+1))
+		t.reachable = false
+	case OP_SKIP_DEFAULT:
+		t.jump(ROP_SKIP_DEFAULT, int(t.chunk.Code[offset+1]), offset+4+t.chunk.readShort(offset+2))
+	case OP_FOR_ITER:
+		// The item lands in the slot above the iterable and the position,
+		// whichever way the loop goes.
+		t.jump(ROP_FOR_ITER, int(t.chunk.Code[offset+1]), offset+4+t.chunk.readShort(offset+2))
+		t.push(operand{OPERAND_SLOT, len(t.stack)})
+	case OP_CALL:
+		// The callee may change any captured local, and its frame starts
+		// at the callee's register, so everything below goes to its slot.
+		argCount := int(t.chunk.Code[offset+1])
+		t.flush()
+		t.stack = t.stack[:len(t.stack)-argCount-1]
+		t.produce(ROP_CALL, argCount, 0)
+		t.produced = -1
+	case OP_SPAWN:
+		// The callee and arguments are copied to the new thread's stack
+		// from their slots, where the thread then goes.
+		argCount := int(t.chunk.Code[offset+1])
+		t.flush()
+		t.stack = t.stack[:len(t.stack)-argCount-1]
+		t.produce(ROP_SPAWN, argCount, 0)
+		t.produced = -1
+	case OP_EXTEND:
+		spread := t.rk(t.pop())
+		t.emit(regABC(ROP_EXTEND, t.rk(t.peek()), spread, 0))
+	case OP_CALL_SPREAD:
+		constant := int(t.chunk.Code[offset+1])
+		keywordCount := len(AsList(t.chunk.Constants[constant]).Items)
+		t.flush()
+		t.stack = t.stack[:len(t.stack)-keywordCount-2]
+		t.produce(ROP_CALL_SPREAD, constant, 0)
+		t.produced = -1
+	case OP_CALL_NAMED:
+		argCount := int(t.chunk.Code[offset+1])
+		t.flush()
+		t.stack = t.stack[:len(t.stack)-argCount-1]
+		t.produce(ROP_CALL_NAMED, argCount, int(t.chunk.Code[offset+2]))
+		t.produced = -1
+	case OP_SPAWN_NAMED:
+		argCount := int(t.chunk.Code[offset+1])
+		t.flush()
+		t.stack = t.stack[:len(t.stack)-argCount-1]
+		t.produce(ROP_SPAWN_NAMED, argCount, int(t.chunk.Code[offset+2]))
+		t.produced = -1
+	case OP_SPAWN_SPREAD:
+		constant := int(t.chunk.Code[offset+1])
+		keywordCount := len(AsList(t.chunk.Constants[constant]).Items)
+		t.flush()
+		t.stack = t.stack[:len(t.stack)-keywordCount-2]
+		t.produce(ROP_SPAWN_SPREAD, constant, 0)
+		t.produced = -1
+	case OP_CLOSURE:
+		// Captured locals must be in their slots for the closure to point at.
+		t.flush()
+		constant := int(t.chunk.Code[offset+1])
+		t.produce(ROP_CLOSURE, constant, 0)
+		t.produced = -1
+		function := AsFunction(t.chunk.Constants[constant])
+		for i := 0; i < function.UpvalueCount; i++ {
+			isLocal := int(t.chunk.Code[offset+2+2*i])
+			index := int(t.chunk.Code[offset+3+2*i])
+			t.emit(regABC(0, isLocal, index, 0))
+		}
+	case OP_CLOSE_UPVALUE:
+		t.materialize(len(t.stack) - 1)
+		t.pop()
+		t.emit(regABC(ROP_CLOSE_UPVALUE, len(t.stack), 0, 0))
+	case OP_IMPORT:
+		// A module's top-level code runs in a frame at the destination.
+		t.flush()
+		t.produce(ROP_IMPORT, int(t.chunk.Code[offset+1]), 0)
+		t.produced = -1
+	case OP_THROW:
+		t.emit(regABC(ROP_THROW, 0, t.rk(t.pop()), 0))
+		t.reachable = false
+	case OP_YIELD:
+		// Everything below the value is saved with the generator, so it
+		// all has to be in its own slot.
+		t.flush()
+		value := t.rk(t.pop())
+		t.emit(regABC(ROP_YIELD, len(t.stack), value, 0))
+	case OP_RETURN:
+		t.emit(regABC(ROP_RETURN, 0, t.rk(t.pop()), 0))
+		t.reachable = false
+	}
+	return offset + stackInstructionLength(t.chunk, offset)
+}
+
+func (t *regTranslator) emit(instruction RegInstruction) int {
+	t.out.Code = append(t.out.Code, instruction)
+	t.out.Lines.add(t.line, t.column)
+	t.produced = -1
+	return len(t.out.Code) - 1
+}
+
+func (t *regTranslator) push(value operand) {
+	t.stack = append(t.stack, value)
+	t.produced = -1
+}
+
+func (t *regTranslator) pop() operand {
+	value := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+	return value
+}
+
+func (t *regTranslator) peek() operand {
+	return t.stack[len(t.stack)-1]
+}
+
+// produce emits an instruction that writes a fresh value into the slot the
+// stack machine would have pushed it to.
+func (t *regTranslator) produce(op int, b, c int) {
+	slot := len(t.stack)
+	pc := t.emit(regABC(op, slot, b, c))
+	t.push(operand{OPERAND_SLOT, slot})
+	t.produced = pc
+}
+
+func (t *regTranslator) binary(op int) {
+	b := t.rk(t.pop())
+	a := t.rk(t.pop())
+	t.produce(op, a, b)
+}
+
+func (t *regTranslator) rk(value operand) int {
+	if value.kind == OPERAND_CONSTANT {
+		return RK_CONSTANT | value.index
+	}
+	return value.index
+}
+
+func (t *regTranslator) literal(value Value) int {
+	if index, ok := t.literals[value]; ok {
+		return index
+	}
+	t.out.Constants = append(t.out.Constants, value)
+	t.literals[value] = len(t.out.Constants) - 1
+	return len(t.out.Constants) - 1
+}
+
+// materialize copies a pending local or constant, or a duplicate of a
+// lower slot, into its own slot.
+func (t *regTranslator) materialize(slot int) {
+	value := t.stack[slot]
+	if value.kind == OPERAND_SLOT && value.index == slot {
+		return
+	}
+	t.emit(regABC(ROP_MOVE, slot, t.rk(value), 0))
+	t.stack[slot] = operand{OPERAND_SLOT, slot}
+}
+
+// materializeTop puts the top count values in consecutive slots, for
+// instructions that take a run of registers.
+func (t *regTranslator) materializeTop(count int) {
+	for slot := len(t.stack) - count; slot < len(t.stack); slot++ {
+		t.materialize(slot)
+	}
+}
+
+func (t *regTranslator) flush() {
+	for slot := range t.stack {
+		t.materialize(slot)
+	}
+}
+
+// bury moves the top operand depth places down. Operands held in
+// registers shift up a register each, so the buried one is parked in the
+// free register above the top until its new slot has been vacated.
+func (t *regTranslator) bury(depth int) {
+	top := len(t.stack) - 1
+	value := t.stack[top]
+	if value.kind == OPERAND_SLOT {
+		t.emit(regABC(ROP_MOVE, top+1, value.index, 0))
+		value = operand{OPERAND_SLOT, top + 1}
+	}
+	for slot := top; slot > top-depth; slot-- {
+		below := t.stack[slot-1]
+		if below.kind == OPERAND_SLOT {
+			t.emit(regABC(ROP_MOVE, slot, below.index, 0))
+			below = operand{OPERAND_SLOT, slot}
+		}
+		t.stack[slot] = below
+	}
+	t.stack[top-depth] = value
+	if value.kind == OPERAND_SLOT {
+		t.materialize(top - depth)
+	}
+}
+
+// resetTo starts the stack afresh at a label, with every operand in its
+// own slot. Whatever was produced before came from one predecessor only,
+// so it is no longer there to retarget.
+func (t *regTranslator) resetTo(depth int) {
+	t.produced = -1
+	t.stack = t.stack[:0]
+	for slot := 0; slot < depth; slot++ {
+		t.stack = append(t.stack, operand{OPERAND_SLOT, slot})
+	}
+}
+
+func (t *regTranslator) setLocal(slot int) {
+	top := len(t.stack) - 1
+	aliased := false
+	for i := 0; i < top; i++ {
+		if t.stack[i].kind == OPERAND_LOCAL && t.stack[i].index == slot {
+			aliased = true
+		}
+	}
+
+	if !aliased && t.produced != -1 && top != slot {
+		// `a = b + c` computes straight into a.
+		pc := t.produced
+		instruction := t.out.Code[pc]
+		t.out.Code[pc] = regABC(int(instruction.Op()), slot, instruction.B(), instruction.C())
+		t.stack[top] = operand{OPERAND_LOCAL, slot}
+		t.stack[slot] = operand{OPERAND_SLOT, slot}
+		t.produced = -1
+		return
+	}
+
+	for i := 0; i < top; i++ {
+		if t.stack[i].kind == OPERAND_LOCAL && t.stack[i].index == slot {
+			t.materialize(i)
+		}
+	}
+	if value := t.rk(t.stack[top]); value != slot {
+		t.emit(regABC(ROP_MOVE, slot, value, 0))
+	}
+	t.stack[slot] = operand{OPERAND_SLOT, slot}
+}
+
+func (t *regTranslator) jump(op int, a int, target int) {
+	t.flush()
+	pc := t.emit(regAJ(op, a, 0))
+	t.patches[pc] = target
+}
+
+// bitwiseOps maps ROP_BIT_AND through ROP_SHIFT_RIGHT onto the stack
+// opcodes vm.bitwise dispatches on.
+var bitwiseOps = [...]uint8{OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR, OP_SHIFT_LEFT, OP_SHIFT_RIGHT}
+
+func (vm *VM) runRegisters() InterpretResult {
+	var frame *CallFrame
+	var code []RegInstruction
+	var constants, registers []Value
+	// load switches to the frame on top, after a call or a return.
+	load := func() {
+		frame = vm.frame()
+		chunk := frame.Closure.Function.registers()
+		code = chunk.Code
+		constants = chunk.Constants
+		registers = vm.Stack[frame.Slots:]
+		vm.Globals = frame.Closure.Function.Module.Globals
+	}
+	load()
+
+	rk := func(operand int) Value {
+		if operand&RK_CONSTANT != 0 {
+			return constants[operand&^RK_CONSTANT]
+		}
+		return registers[operand]
+	}
+
+	for {
+		instruction := code[vm.Ip]
+		vm.Ip++
+
+		switch instruction.Op() {
+		case ROP_MOVE:
+			registers[instruction.A()] = rk(instruction.B())
+		case ROP_GET_GLOBAL:
+			name := AsString(constants[instruction.B()])
+			value, ok := vm.Globals[name]
+			if !ok {
+				vm.runtimeError("Undefined variable '%s'", name)
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[instruction.A()] = value
+		case ROP_DEFINE_GLOBAL, ROP_DEFINE_CONST:
+			name := AsString(constants[instruction.A()])
+			if !vm.defineGlobal(name, rk(instruction.B()), instruction.Op() == ROP_DEFINE_CONST) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case ROP_SET_GLOBAL:
+			name := AsString(constants[instruction.A()])
+			if _, ok := vm.Globals[name]; !ok {
+				vm.runtimeError("Undefined variable '%s'.", name)
+				return INTERPRET_RUNTIME_ERROR
+			}
+			if frame.Closure.Function.Module.Constants[name] {
+				vm.runtimeError("Cannot assign to constant '%s'.", name)
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.Globals[name] = rk(instruction.B())
+		case ROP_EQUAL:
+			registers[instruction.A()] = BoolVal(valuesEqual(rk(instruction.B()), rk(instruction.C())))
+		case ROP_GREATER, ROP_LESS, ROP_SUBTRACT, ROP_MULTIPLY, ROP_DIVIDE,
+			ROP_INT_DIVIDE, ROP_MODULO, ROP_POWER:
+			a, b := rk(instruction.B()), rk(instruction.C())
+			if !IsNumber(a) || !IsNumber(b) {
+				vm.runtimeError("Operands must be numbers.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			var result Value
+			switch instruction.Op() {
+			case ROP_GREATER:
+				result = BoolVal(AsNumber(a) > AsNumber(b))
+			case ROP_LESS:
+				result = BoolVal(AsNumber(a) < AsNumber(b))
+			case ROP_SUBTRACT:
+				result = NumberVal(AsNumber(a) - AsNumber(b))
+			case ROP_MULTIPLY:
+				result = NumberVal(AsNumber(a) * AsNumber(b))
+			case ROP_DIVIDE:
+				result = NumberVal(AsNumber(a) / AsNumber(b))
+			case ROP_INT_DIVIDE:
+				result = NumberVal(math.Floor(AsNumber(a) / AsNumber(b)))
+			case ROP_MODULO:
+				result = NumberVal(modulo(AsNumber(a), AsNumber(b)))
+			case ROP_POWER:
+				result = NumberVal(math.Pow(AsNumber(a), AsNumber(b)))
+			}
+			registers[instruction.A()] = result
+		case ROP_ADD:
+			a, b := rk(instruction.B()), rk(instruction.C())
+			if IsString(a) && IsString(b) {
+				registers[instruction.A()] = concatenate(a, b)
+			} else if IsNumber(a) && IsNumber(b) {
+				registers[instruction.A()] = NumberVal(AsNumber(a) + AsNumber(b))
+			} else {
+				vm.runtimeError("Operands must be two numbers or two strings.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case ROP_BIT_AND, ROP_BIT_OR, ROP_BIT_XOR, ROP_SHIFT_LEFT, ROP_SHIFT_RIGHT:
+			op := bitwiseOps[instruction.Op()-ROP_BIT_AND]
+			result, ok := vm.bitwise(op, rk(instruction.B()), rk(instruction.C()))
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[instruction.A()] = result
+		case ROP_BIT_NOT:
+			result, ok := vm.bitNot(rk(instruction.B()))
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[instruction.A()] = result
+		case ROP_TO_STRING:
+			value := rk(instruction.B())
+			if !IsString(value) {
+				value = StringVal(toString(value))
+			}
+			registers[instruction.A()] = value
+		case ROP_NOT:
+			registers[instruction.A()] = BoolVal(isFalsey(rk(instruction.B())))
+		case ROP_NEGATE:
+			value := rk(instruction.B())
+			if !IsNumber(value) {
+				vm.runtimeError("Operand must be a number.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[instruction.A()] = NumberVal(-AsNumber(value))
+		case ROP_BUILD_LIST:
+			start := instruction.A()
+			items := append([]Value{}, registers[start:start+instruction.B()]...)
+			registers[start] = ObjVal(newList(items))
+		case ROP_BUILD_MAP:
+			start := instruction.A()
+			value, ok := vm.buildMap(registers[start : start+instruction.B()])
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[start] = value
+		case ROP_GET_INDEX:
+			value, ok := vm.getIndex(rk(instruction.B()), rk(instruction.C()))
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[instruction.A()] = value
+		case ROP_SET_INDEX:
+			if !vm.setIndex(rk(instruction.A()), rk(instruction.B()), rk(instruction.C())) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case ROP_GET_PROPERTY:
+			value, ok := vm.getProperty(rk(instruction.B()), AsString(constants[instruction.C()]))
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[instruction.A()] = value
+		case ROP_INVOKE:
+			receiver := instruction.A()
+			if handled, ok := vm.invokeFrame(AsString(constants[instruction.B()]), instruction.C(), frame.Slots+receiver); handled {
+				if !ok {
+					return INTERPRET_RUNTIME_ERROR
+				}
+				load()
+				break
+			}
+			args := registers[receiver+1 : receiver+1+instruction.C()]
+			result, ok := vm.invoke(AsString(constants[instruction.B()]), registers[receiver], args)
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[receiver] = result
+		case ROP_PRINT:
+			printValues(rk(instruction.B()))
+			fmt.Printf("\n")
+		case ROP_JUMP:
+			if instruction.J() < vm.Ip {
+				vm.tick()
+			}
+			vm.Ip = instruction.J()
+		case ROP_JUMP_IF_FALSE:
+			if isFalsey(registers[instruction.A()]) {
+				vm.Ip = instruction.J()
+			}
+		case ROP_SKIP_DEFAULT:
+			if !IsAbsent(registers[instruction.A()]) {
+				vm.Ip = instruction.J()
+			}
+		case ROP_FOR_ITER:
+			slot := instruction.A()
+			if IsObjType(registers[slot], OBJ_GENERATOR) {
+				if !vm.iterateGenerator(AsGenerator(registers[slot]), frame.Slots+slot+2, instruction.J()) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+				load()
+				break
+			}
+			item, more, ok := vm.nextItem(registers[slot], &registers[slot+1])
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			registers[slot+2] = item
+			if !more {
+				vm.Ip = instruction.J()
+			}
+		case ROP_GET_UPVALUE:
+			registers[instruction.A()] = *frame.Closure.Upvalues[instruction.B()].Location
+		case ROP_SET_UPVALUE:
+			*frame.Closure.Upvalues[instruction.A()].Location = rk(instruction.B())
+		case ROP_CALL:
+			callee := instruction.A()
+			if !vm.callValue(registers[callee], instruction.B(), nil, frame.Slots+callee) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			load()
+		case ROP_SPAWN:
+			if !vm.spawn(instruction.B(), nil, frame.Slots+instruction.A()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case ROP_EXTEND:
+			if !vm.extend(rk(instruction.A()), rk(instruction.B())) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case ROP_CALL_SPREAD:
+			names := AsList(constants[instruction.B()]).Items
+			base := frame.Slots + instruction.A()
+			argCount, ok := vm.spreadArguments(base, len(names))
+			if !ok || !vm.callValue(vm.Stack[base], argCount, names, base) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			load()
+		case ROP_CALL_NAMED:
+			callee := instruction.A()
+			names := AsList(constants[instruction.C()]).Items
+			if !vm.callValue(registers[callee], instruction.B(), names, frame.Slots+callee) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			load()
+		case ROP_SPAWN_NAMED:
+			names := AsList(constants[instruction.C()]).Items
+			if !vm.spawn(instruction.B(), names, frame.Slots+instruction.A()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case ROP_SPAWN_SPREAD:
+			names := AsList(constants[instruction.B()]).Items
+			base := frame.Slots + instruction.A()
+			argCount, ok := vm.spreadArguments(base, len(names))
+			if !ok || !vm.spawn(argCount, names, base) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			// Spreading may have grown the stack.
+			load()
+		case ROP_CLOSURE:
+			function := AsFunction(constants[instruction.B()])
+			closure := vm.newClosureFrom(function, frame, func() (bool, int) {
+				capture := code[vm.Ip]
+				vm.Ip++
+				return capture.A() == 1, capture.B()
+			})
+			registers[instruction.A()] = ObjVal(closure)
+		case ROP_CLOSE_UPVALUE:
+			vm.closeUpvalues(frame.Slots + instruction.A())
+		case ROP_IMPORT:
+			if !vm.importModule(AsString(constants[instruction.B()]), frame.Slots+instruction.A()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			load()
+		case ROP_THROW:
+			vm.throw(rk(instruction.B()))
+			return INTERPRET_RUNTIME_ERROR
+		case ROP_RETURN:
+			result := rk(instruction.B())
+			vm.closeUpvalues(frame.Slots)
+			vm.FrameCount--
+			if vm.FrameCount == 0 {
+				if !vm.finishFiber(result) {
+					return INTERPRET_OK
+				}
+				load()
+				break
+			}
+
+			vm.Stack[frame.Slots] = vm.returnValue(frame, result)
+			load()
+			vm.Ip = frame.Ip
+		case ROP_YIELD:
+			vm.yield(frame, instruction.A(), rk(instruction.B()))
+			load()
+			vm.Ip = frame.Ip
+		}
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"unicode"
+	"unicode/utf8"
 )
 
 type TokenType int
@@ -13,59 +15,104 @@ const (
 	TOKEN_RIGHT_PAREN
 	TOKEN_LEFT_BRACE
 	TOKEN_RIGHT_BRACE
+	TOKEN_LEFT_BRACKET
+	TOKEN_RIGHT_BRACKET
 	TOKEN_COMMA
 	TOKEN_DOT
+	TOKEN_ELLIPSIS
 	TOKEN_MINUS
 	TOKEN_PLUS
 	TOKEN_SEMICOLON
+	TOKEN_COLON
+	TOKEN_QUESTION
 	TOKEN_SLASH
 	TOKEN_STAR
+	TOKEN_PERCENT
+	TOKEN_AMPERSAND
+	TOKEN_PIPE
+	TOKEN_CARET
 	// One or two character tokens.
+	TOKEN_MINUS_EQUAL
+	TOKEN_MINUS_MINUS
+	TOKEN_PLUS_EQUAL
+	TOKEN_PLUS_PLUS
+	TOKEN_SLASH_EQUAL
+	TOKEN_STAR_EQUAL
+	TOKEN_STAR_STAR
+	TOKEN_TILDE
+	TOKEN_TILDE_SLASH
 	TOKEN_BANG
 	TOKEN_BANG_EQUAL
 	TOKEN_EQUAL
 	TOKEN_EQUAL_EQUAL
+	TOKEN_ARROW
 	TOKEN_GREATER
 	TOKEN_GREATER_EQUAL
+	TOKEN_GREATER_GREATER
 	TOKEN_LESS
 	TOKEN_LESS_EQUAL
+	TOKEN_LESS_LESS
 	// Literals.
 	TOKEN_IDENTIFIER
 	TOKEN_STRING
+	TOKEN_INTERPOLATION
 	TOKEN_NUMBER
 	// Keywords.
 	TOKEN_AND
+	TOKEN_AS
+	TOKEN_BREAK
+	TOKEN_CASE
+	TOKEN_CATCH
 	TOKEN_CLASS
+	TOKEN_CONST
+	TOKEN_CONTINUE
+	TOKEN_DEFAULT
 	TOKEN_ELSE
+	TOKEN_EXPORT
 	TOKEN_FALSE
+	TOKEN_FINALLY
 	TOKEN_FOR
+	TOKEN_FROM
 	TOKEN_FUN
 	TOKEN_IF
+	TOKEN_IMPORT
+	TOKEN_IN
 	TOKEN_NIL
 	TOKEN_OR
 	TOKEN_PRINT
 	TOKEN_RETURN
+	TOKEN_SPAWN
 	TOKEN_SUPER
+	TOKEN_SWITCH
 	TOKEN_THIS
+	TOKEN_THROW
 	TOKEN_TRUE
+	TOKEN_TRY
 	TOKEN_VAR
 	TOKEN_WHILE
+	TOKEN_YIELD
 
 	TOKEN_ERROR
 	TOKEN_EOF
 )
 
 type Scanner struct {
-	Source  []rune
-	Start   int
-	Current int
-	Line    int
+	Source    []rune
+	Start     int
+	Current   int
+	Line      int
+	LineStart int
+	Column    int
+	// Interpolations holds, for each `${` still open, how many braces
+	// inside it are open, so the `}` that ends it can be told apart.
+	Interpolations []int
 }
 
 func (scanner *Scanner) InitScanner(source string) {
 	scanner.Source = []rune(source)
 	scanner.Current = 0
 	scanner.Line = 1
+	scanner.LineStart = 0
 }
 
 type Token struct {
@@ -73,18 +120,24 @@ type Token struct {
 	start  []rune
 	length int
 	line   int
+	column int
 }
 
 func (scanner *Scanner) scanToken() Token {
-	scanner.skipWhitespace()
+	terminated := scanner.skipWhitespace()
 	scanner.Start = scanner.Current
+	scanner.Column = scanner.Start - scanner.LineStart + 1
+
+	if !terminated {
+		return scanner.errorToken("Unterminated block comment.")
+	}
 
 	if scanner.isAtEnd() {
 		return scanner.makeToken(TOKEN_EOF)
 	}
 
 	c := scanner.advance()
-	if unicode.IsLetter(c) {
+	if isAlpha(c) {
 		return scanner.identifier()
 	}
 	if unicode.IsDigit(c) {
@@ -97,23 +150,79 @@ func (scanner *Scanner) scanToken() Token {
 	case ')':
 		return scanner.makeToken(TOKEN_RIGHT_PAREN)
 	case '{':
+		if n := len(scanner.Interpolations); n > 0 {
+			scanner.Interpolations[n-1]++
+		}
 		return scanner.makeToken(TOKEN_LEFT_BRACE)
 	case '}':
+		if n := len(scanner.Interpolations); n > 0 {
+			if scanner.Interpolations[n-1] == 0 {
+				scanner.Interpolations = scanner.Interpolations[:n-1]
+				return scanner.string()
+			}
+			scanner.Interpolations[n-1]--
+		}
 		return scanner.makeToken(TOKEN_RIGHT_BRACE)
+	case '[':
+		return scanner.makeToken(TOKEN_LEFT_BRACKET)
+	case ']':
+		return scanner.makeToken(TOKEN_RIGHT_BRACKET)
 	case ';':
 		return scanner.makeToken(TOKEN_SEMICOLON)
+	case ':':
+		return scanner.makeToken(TOKEN_COLON)
+	case '?':
+		return scanner.makeToken(TOKEN_QUESTION)
 	case ',':
 		return scanner.makeToken(TOKEN_COMMA)
 	case '.':
+		if scanner.peek() == '.' && scanner.peekNext() == '.' {
+			scanner.Current += 2
+			return scanner.makeToken(TOKEN_ELLIPSIS)
+		}
 		return scanner.makeToken(TOKEN_DOT)
 	case '-':
+		if scanner.match('=') {
+			return scanner.makeToken(TOKEN_MINUS_EQUAL)
+		}
+		if scanner.match('-') {
+			return scanner.makeToken(TOKEN_MINUS_MINUS)
+		}
 		return scanner.makeToken(TOKEN_MINUS)
 	case '+':
+		if scanner.match('=') {
+			return scanner.makeToken(TOKEN_PLUS_EQUAL)
+		}
+		if scanner.match('+') {
+			return scanner.makeToken(TOKEN_PLUS_PLUS)
+		}
 		return scanner.makeToken(TOKEN_PLUS)
 	case '/':
+		if scanner.match('=') {
+			return scanner.makeToken(TOKEN_SLASH_EQUAL)
+		}
 		return scanner.makeToken(TOKEN_SLASH)
 	case '*':
+		if scanner.match('=') {
+			return scanner.makeToken(TOKEN_STAR_EQUAL)
+		}
+		if scanner.match('*') {
+			return scanner.makeToken(TOKEN_STAR_STAR)
+		}
 		return scanner.makeToken(TOKEN_STAR)
+	case '%':
+		return scanner.makeToken(TOKEN_PERCENT)
+	case '&':
+		return scanner.makeToken(TOKEN_AMPERSAND)
+	case '|':
+		return scanner.makeToken(TOKEN_PIPE)
+	case '^':
+		return scanner.makeToken(TOKEN_CARET)
+	case '~':
+		if scanner.match('/') {
+			return scanner.makeToken(TOKEN_TILDE_SLASH)
+		}
+		return scanner.makeToken(TOKEN_TILDE)
 	case '!':
 		if scanner.match('=') {
 			return scanner.makeToken(TOKEN_BANG_EQUAL)
@@ -123,16 +232,25 @@ func (scanner *Scanner) scanToken() Token {
 		if scanner.match('=') {
 			return scanner.makeToken(TOKEN_EQUAL_EQUAL)
 		}
+		if scanner.match('>') {
+			return scanner.makeToken(TOKEN_ARROW)
+		}
 		return scanner.makeToken(TOKEN_EQUAL)
 	case '<':
 		if scanner.match('=') {
 			return scanner.makeToken(TOKEN_LESS_EQUAL)
 		}
+		if scanner.match('<') {
+			return scanner.makeToken(TOKEN_LESS_LESS)
+		}
 		return scanner.makeToken(TOKEN_LESS)
 	case '>':
 		if scanner.match('=') {
 			return scanner.makeToken(TOKEN_GREATER_EQUAL)
 		}
+		if scanner.match('>') {
+			return scanner.makeToken(TOKEN_GREATER_GREATER)
+		}
 		return scanner.makeToken(TOKEN_GREATER)
 	case '"':
 		return scanner.string()
@@ -156,8 +274,8 @@ func (scanner *Scanner) peek() rune {
 }
 
 func (scanner *Scanner) peekNext() rune {
-	if scanner.isAtEnd() {
-		return ' '
+	if scanner.Current+1 >= len(scanner.Source) {
+		return 0
 	}
 	return scanner.Source[scanner.Current+1]
 }
@@ -179,6 +297,7 @@ func (scanner *Scanner) makeToken(Type TokenType) Token {
 	token.start = scanner.Source[scanner.Start:scanner.Current]
 	token.length = scanner.Current - scanner.Start
 	token.line = scanner.Line
+	token.column = scanner.Column
 	return token
 }
 
@@ -188,15 +307,19 @@ func (scanner *Scanner) errorToken(message string) Token {
 	token.start = []rune(message)
 	token.length = len(message)
 	token.line = scanner.Line
+	token.column = scanner.Column
 	return token
 }
 
-func (scanner *Scanner) skipWhitespace() {
+// skipWhitespace skips whitespace and comments. It reports false if a
+// block comment runs to the end of the source.
+func (scanner *Scanner) skipWhitespace() bool {
 	for !scanner.isAtEnd() {
 		switch scanner.peek() {
 		case ' ', '\r', '\t', '\n':
 			if scanner.peek() == '\n' {
 				scanner.Line++
+				scanner.LineStart = scanner.Current + 1
 			}
 			scanner.advance()
 		case '/':
@@ -204,13 +327,42 @@ func (scanner *Scanner) skipWhitespace() {
 				for scanner.peek() != '\n' && !scanner.isAtEnd() {
 					scanner.advance()
 				}
+			} else if scanner.peekNext() == '*' {
+				if !scanner.blockComment() {
+					return false
+				}
 			} else {
-				return
+				return true
 			}
 		default:
-			return
+			return true
+		}
+	}
+	return true
+}
+
+// blockComment skips a /* */ comment. Comments nest, so each /* inside
+// needs its own */. It reports false if the source ends first.
+func (scanner *Scanner) blockComment() bool {
+	scanner.advance()
+	scanner.advance()
+	for depth := 1; depth > 0; {
+		if scanner.isAtEnd() {
+			return false
+		}
+		switch c := scanner.advance(); {
+		case c == '/' && scanner.peek() == '*':
+			scanner.advance()
+			depth++
+		case c == '*' && scanner.peek() == '/':
+			scanner.advance()
+			depth--
+		case c == '\n':
+			scanner.Line++
+			scanner.LineStart = scanner.Current
 		}
 	}
+	return true
 }
 func (scanner *Scanner) checkKeyword(start int, length int, rest string, Type TokenType) TokenType {
 	if scanner.Current-scanner.Start == start+length {
@@ -222,8 +374,15 @@ func (scanner *Scanner) checkKeyword(start int, length int, rest string, Type To
 	return TOKEN_IDENTIFIER
 }
 
+// isAlpha reports whether c can start an identifier. A '_' inside a number
+// is a digit separator instead, which number() consumes before it gets
+// here.
+func isAlpha(c rune) bool {
+	return unicode.IsLetter(c) || c == '_'
+}
+
 func (scanner *Scanner) identifier() Token {
-	for unicode.IsLetter(scanner.peek()) || unicode.IsDigit(scanner.peek()) {
+	for isAlpha(scanner.peek()) || unicode.IsDigit(scanner.peek()) {
 		scanner.advance()
 	}
 	return scanner.makeToken(scanner.identifierType())
@@ -232,24 +391,70 @@ func (scanner *Scanner) identifier() Token {
 func (scanner *Scanner) identifierType() TokenType {
 	switch scanner.Source[scanner.Start] {
 	case 'a':
-		return scanner.checkKeyword(1, 2, "nd", TOKEN_AND)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'n':
+				return scanner.checkKeyword(1, 2, "nd", TOKEN_AND)
+			case 's':
+				return scanner.checkKeyword(1, 1, "s", TOKEN_AS)
+			}
+		}
+	case 'b':
+		return scanner.checkKeyword(1, 4, "reak", TOKEN_BREAK)
 	case 'c':
-		return scanner.checkKeyword(1, 4, "lass", TOKEN_CLASS)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'a':
+				if scanner.Current-scanner.Start > 2 && scanner.Source[scanner.Start+2] == 's' {
+					return scanner.checkKeyword(2, 2, "se", TOKEN_CASE)
+				}
+				return scanner.checkKeyword(1, 4, "atch", TOKEN_CATCH)
+			case 'l':
+				return scanner.checkKeyword(1, 4, "lass", TOKEN_CLASS)
+			case 'o':
+				if scanner.Current-scanner.Start > 3 && scanner.Source[scanner.Start+3] == 's' {
+					return scanner.checkKeyword(2, 3, "nst", TOKEN_CONST)
+				}
+				return scanner.checkKeyword(1, 7, "ontinue", TOKEN_CONTINUE)
+			}
+		}
+	case 'd':
+		return scanner.checkKeyword(1, 6, "efault", TOKEN_DEFAULT)
 	case 'e':
-		return scanner.checkKeyword(1, 3, "lse", TOKEN_ELSE)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'l':
+				return scanner.checkKeyword(1, 3, "lse", TOKEN_ELSE)
+			case 'x':
+				return scanner.checkKeyword(1, 5, "xport", TOKEN_EXPORT)
+			}
+		}
 	case 'f':
 		if scanner.Current-scanner.Start > 1 {
 			switch scanner.Source[scanner.Start+1] {
 			case 'a':
 				return scanner.checkKeyword(1, 4, "alse", TOKEN_FALSE)
+			case 'i':
+				return scanner.checkKeyword(1, 6, "inally", TOKEN_FINALLY)
 			case 'o':
 				return scanner.checkKeyword(1, 2, "or", TOKEN_FOR)
+			case 'r':
+				return scanner.checkKeyword(1, 3, "rom", TOKEN_FROM)
 			case 'u':
 				return scanner.checkKeyword(1, 2, "un", TOKEN_FUN)
 			}
 		}
 	case 'i':
-		return scanner.checkKeyword(1, 1, "f", TOKEN_IF)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'f':
+				return scanner.checkKeyword(1, 1, "f", TOKEN_IF)
+			case 'm':
+				return scanner.checkKeyword(1, 5, "mport", TOKEN_IMPORT)
+			case 'n':
+				return scanner.checkKeyword(1, 1, "n", TOKEN_IN)
+			}
+		}
 	case 'n':
 		return scanner.checkKeyword(1, 2, "il", TOKEN_NIL)
 	case 'o':
@@ -259,13 +464,28 @@ func (scanner *Scanner) identifierType() TokenType {
 	case 'r':
 		return scanner.checkKeyword(1, 5, "eturn", TOKEN_RETURN)
 	case 's':
-		return scanner.checkKeyword(1, 4, "uper", TOKEN_SUPER)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'p':
+				return scanner.checkKeyword(1, 4, "pawn", TOKEN_SPAWN)
+			case 'u':
+				return scanner.checkKeyword(1, 4, "uper", TOKEN_SUPER)
+			case 'w':
+				return scanner.checkKeyword(1, 5, "witch", TOKEN_SWITCH)
+			}
+		}
 	case 't':
 		if scanner.Current-scanner.Start > 1 {
 			switch scanner.Source[scanner.Start+1] {
 			case 'h':
+				if scanner.Current-scanner.Start > 2 && scanner.Source[scanner.Start+2] == 'r' {
+					return scanner.checkKeyword(2, 3, "row", TOKEN_THROW)
+				}
 				return scanner.checkKeyword(1, 3, "his", TOKEN_THIS)
 			case 'r':
+				if scanner.Current-scanner.Start > 2 && scanner.Source[scanner.Start+2] == 'y' {
+					return scanner.checkKeyword(2, 1, "y", TOKEN_TRY)
+				}
 				return scanner.checkKeyword(1, 3, "rue", TOKEN_TRUE)
 			}
 		}
@@ -273,30 +493,113 @@ func (scanner *Scanner) identifierType() TokenType {
 		return scanner.checkKeyword(1, 2, "ar", TOKEN_VAR)
 	case 'w':
 		return scanner.checkKeyword(1, 4, "hile", TOKEN_WHILE)
+	case 'y':
+		return scanner.checkKeyword(1, 4, "ield", TOKEN_YIELD)
 	}
 	return TOKEN_IDENTIFIER
 }
 
 func (scanner *Scanner) number() Token {
-	for unicode.IsDigit(scanner.peek()) {
-		scanner.advance()
+	if scanner.Source[scanner.Start] == '0' {
+		base := 0
+		switch scanner.peek() {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+		if base != 0 {
+			scanner.advance()
+			if !isDigitIn(scanner.peek(), base) {
+				return scanner.errorToken("Expect digits after number prefix.")
+			}
+			scanner.digits(base)
+			return scanner.makeToken(TOKEN_NUMBER)
+		}
 	}
 
-	if scanner.peek() == '.' && unicode.IsDigit(scanner.peekNext()) {
+	scanner.digits(10)
+
+	if scanner.peek() == '.' && isDigitIn(scanner.peekNext(), 10) {
 		scanner.advance()
+		scanner.digits(10)
+	}
 
-		for unicode.IsDigit(scanner.peek()) {
+	if scanner.peek() == 'e' || scanner.peek() == 'E' {
+		next := scanner.peekNext()
+		signed := next == '+' || next == '-'
+		if isDigitIn(next, 10) ||
+			(signed && scanner.Current+2 < len(scanner.Source) && isDigitIn(scanner.Source[scanner.Current+2], 10)) {
 			scanner.advance()
+			if signed {
+				scanner.advance()
+			}
+			scanner.digits(10)
 		}
 	}
 
 	return scanner.makeToken(TOKEN_NUMBER)
 }
 
+// digits consumes a run of digits in base. A single '_' may separate two
+// digits, as in 1_000_000.
+func (scanner *Scanner) digits(base int) {
+	for {
+		if isDigitIn(scanner.peek(), base) {
+			scanner.advance()
+		} else if scanner.peek() == '_' && isDigitIn(scanner.peekNext(), base) &&
+			isDigitIn(scanner.Source[scanner.Current-1], base) {
+			scanner.advance()
+		} else {
+			return
+		}
+	}
+}
+
+func isDigitIn(c rune, base int) bool {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') < base
+	case c >= 'a' && c <= 'f':
+		return base == 16
+	case c >= 'A' && c <= 'F':
+		return base == 16
+	}
+	return false
+}
+
+// string scans a string literal, or the segment of one that runs from the
+// `}` ending an interpolated expression. A segment that stops at `${` is
+// a TOKEN_INTERPOLATION and the expression's tokens follow it.
 func (scanner *Scanner) string() Token {
+	// A malformed escape is reported where it starts, but only once the
+	// rest of the string is consumed so scanning resumes after it.
+	var invalid *Token
 	for scanner.peek() != '"' && !scanner.isAtEnd() {
+		if scanner.peek() == '$' && scanner.peekNext() == '{' {
+			scanner.advance()
+			scanner.advance()
+			scanner.Interpolations = append(scanner.Interpolations, 0)
+			if invalid != nil {
+				return *invalid
+			}
+			return scanner.makeToken(TOKEN_INTERPOLATION)
+		}
+		if scanner.peek() == '\\' {
+			line, column := scanner.Line, scanner.Current-scanner.LineStart+1
+			scanner.advance()
+			if message := scanner.escape(); message != "" && invalid == nil {
+				token := scanner.errorToken(message)
+				token.line, token.column = line, column
+				invalid = &token
+			}
+			continue
+		}
 		if scanner.peek() == '\n' {
 			scanner.Line++
+			scanner.LineStart = scanner.Current + 1
 		}
 		scanner.advance()
 	}
@@ -306,9 +609,49 @@ func (scanner *Scanner) string() Token {
 	}
 
 	scanner.advance()
+	if invalid != nil {
+		return *invalid
+	}
 	return scanner.makeToken(TOKEN_STRING)
 }
 
+// escape consumes the escape sequence after a backslash and returns what
+// is wrong with it, or "" if it is well formed. Parser.string decodes it.
+func (scanner *Scanner) escape() string {
+	switch scanner.peek() {
+	case 'n', 't', 'r', '0', '\\', '"', '$':
+		scanner.advance()
+	case 'x':
+		scanner.advance()
+		for i := 0; i < 2; i++ {
+			if !isDigitIn(scanner.peek(), 16) {
+				return "Expect two hex digits after '\\x'."
+			}
+			scanner.advance()
+		}
+	case 'u':
+		scanner.advance()
+		if !scanner.match('{') {
+			return "Expect '{' after '\\u'."
+		}
+		start := scanner.Current
+		for isDigitIn(scanner.peek(), 16) {
+			scanner.advance()
+		}
+		digits := string(scanner.Source[start:scanner.Current])
+		if digits == "" || !scanner.match('}') {
+			return "Expect hex digits and '}' in Unicode escape."
+		}
+		codePoint, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil || !utf8.ValidRune(rune(codePoint)) {
+			return "Invalid Unicode code point in escape."
+		}
+	default:
+		return "Invalid escape sequence."
+	}
+	return ""
+}
+
 func (scanner *Scanner) isAtEnd() bool {
 	return scanner.Current == len(scanner.Source)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptEnv names the script a re-run of the test binary should interpret,
+// so that the threads tests run each script in a process of its own,
+// built with -race when the tests are.
+const scriptEnv = "GO_LOX_SCRIPT"
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(scriptEnv); path != "" {
+		os.Args = []string{os.Args[0], path}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+var (
+	expectOutput       = regexp.MustCompile(`// expect: ?(.*)`)
+	expectRuntimeError = regexp.MustCompile(`// expect runtime error: (.+)`)
+	expectCompileError = regexp.MustCompile(`// (Error.*)`)
+)
+
+// TestThreads runs every script in test/thread and checks what it prints
+// against its expect comments. Under go test -race, a data race between
+// threads fails the script too.
+func TestThreads(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("test", "thread", "*.lox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range scripts {
+		t.Run(filepath.Base(script), func(t *testing.T) {
+			t.Parallel()
+			runScript(t, script)
+		})
+	}
+}
+
+func runScript(t *testing.T, path string) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output, errors []string
+	exitCode := 0
+	for i, line := range strings.Split(string(source), "\n") {
+		if match := expectOutput.FindStringSubmatch(line); match != nil {
+			output = append(output, match[1])
+		} else if match := expectRuntimeError.FindStringSubmatch(line); match != nil {
+			errors = append(errors, match[1])
+			exitCode = 70
+		} else if match := expectCompileError.FindStringSubmatch(line); match != nil {
+			errors = append(errors, fmt.Sprintf("[line %d] %s", i+1, match[1]))
+			exitCode = 65
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0])
+	cmd.Env = append(os.Environ(), scriptEnv+"="+path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		t.Fatal("timed out")
+	}
+	if strings.Contains(stderr.String(), "DATA RACE") {
+		t.Fatalf("data race:\n%s", stderr.String())
+	}
+
+	if got := cmd.ProcessState.ExitCode(); got != exitCode {
+		t.Errorf("exit code %d, want %d (%v)", got, exitCode, err)
+	}
+	if got := lines(stdout.String()); !slices.Equal(got, output) {
+		t.Errorf("output %q, want %q", got, output)
+	}
+	// A runtime error is followed by its stack trace.
+	got := lines(stderr.String())
+	if len(got) < len(errors) || !slices.Equal(got[:len(errors)], errors) {
+		t.Errorf("errors %q, want %q", got, errors)
+	}
+}
+
+func lines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -1,16 +1,24 @@
 package main
 
+import "bytes"
+
 const (
 	OP_CONSTANT = iota
 	OP_NIL
 	OP_TRUE
 	OP_FALSE
 	OP_POP
+	OP_DUP
+	OP_DUP2
+	OP_BURY
 	OP_GET_LOCAL
 	OP_SET_LOCAL
 	OP_GET_GLOBAL
 	OP_DEFINE_GLOBAL
+	OP_DEFINE_CONST
 	OP_SET_GLOBAL
+	OP_GET_UPVALUE
+	OP_SET_UPVALUE
 	OP_EQUAL
 	OP_GREATER
 	OP_LESS
@@ -18,12 +26,42 @@ const (
 	OP_SUBTRACT
 	OP_MULTIPLY
 	OP_DIVIDE
+	OP_INT_DIVIDE
+	OP_MODULO
+	OP_POWER
+	OP_BIT_AND
+	OP_BIT_OR
+	OP_BIT_XOR
+	OP_SHIFT_LEFT
+	OP_SHIFT_RIGHT
+	OP_BIT_NOT
+	OP_TO_STRING
 	OP_NOT
 	OP_NEGATE
+	OP_BUILD_LIST
+	OP_BUILD_MAP
+	OP_GET_INDEX
+	OP_SET_INDEX
+	OP_GET_PROPERTY
+	OP_INVOKE
 	OP_PRINT
 	OP_JUMP
 	OP_JUMP_IF_FALSE
 	OP_LOOP
+	OP_SKIP_DEFAULT
+	OP_FOR_ITER
+	OP_CALL
+	OP_SPAWN
+	OP_CALL_NAMED
+	OP_EXTEND
+	OP_CALL_SPREAD
+	OP_SPAWN_NAMED
+	OP_SPAWN_SPREAD
+	OP_CLOSURE
+	OP_CLOSE_UPVALUE
+	OP_IMPORT
+	OP_THROW
+	OP_YIELD
 	OP_RETURN
 )
 
@@ -36,6 +74,10 @@ const (
 	VAL_NUMBER
 	VAL_STRING
 	VAL_OBJ
+	// VAL_ABSENT fills the slot of a parameter the caller passed nothing
+	// for. The function's prologue stores the default there before any
+	// other code can read it.
+	VAL_ABSENT
 )
 
 // Value represents any value that can be stored in the VM
@@ -44,7 +86,7 @@ type Value struct {
 	Bool   bool
 	Num    float64
 	String string
-	obj    Obj
+	obj    Object
 }
 
 func OBJ_TYPE(value Value) ObjType {
@@ -67,10 +109,14 @@ func StringVal(s string) Value {
 	return Value{Type: VAL_STRING, String: s}
 }
 
-func ObjVal(object Obj) Value {
+func ObjVal(object Object) Value {
 	return Value{Type: VAL_OBJ, obj: object}
 }
 
+func AbsentVal() Value {
+	return Value{Type: VAL_ABSENT}
+}
+
 func IsBool(value Value) bool {
 	return value.Type == VAL_BOOL
 }
@@ -84,7 +130,11 @@ func IsNumber(value Value) bool {
 }
 
 func IsString(value Value) bool {
-	return value.Type == VAL_STRING
+	return value.Type == VAL_STRING || IsObjType(value, OBJ_STRING)
+}
+
+func IsAbsent(value Value) bool {
+	return value.Type == VAL_ABSENT
 }
 
 func IsObj(value Value) bool {
@@ -100,14 +150,45 @@ func AsNumber(value Value) float64 {
 }
 
 func AsString(value Value) string {
+	if IsObjType(value, OBJ_STRING) {
+		return AsObjString(value).text()
+	}
 	return value.String
 }
 
-func AsObj(value Value) Obj {
-	return value.obj
+func AsObj(value Value) *Obj {
+	return value.obj.header()
+}
+
+// HashKey is the form a value takes as a map key. Two values produce the
+// same key exactly when valuesEqual reports them equal, so a NaN key can
+// be stored but never found again, just as NaN never equals itself.
+type HashKey struct {
+	Type ValueType
+	Bool bool
+	Num  float64
+	Str  string
+}
+
+func hashKey(value Value) (HashKey, bool) {
+	switch {
+	case IsString(value):
+		return HashKey{Type: VAL_STRING, Str: AsString(value)}, true
+	case IsBool(value):
+		return HashKey{Type: VAL_BOOL, Bool: AsBool(value)}, true
+	case IsNil(value):
+		return HashKey{Type: VAL_NIL}, true
+	case IsNumber(value):
+		return HashKey{Type: VAL_NUMBER, Num: AsNumber(value)}, true
+	default:
+		return HashKey{}, false
+	}
 }
 
 func valuesEqual(a Value, b Value) bool {
+	if IsString(a) && IsString(b) {
+		return stringsEqual(a, b)
+	}
 	if a.Type != b.Type {
 		return false
 	}
@@ -118,7 +199,28 @@ func valuesEqual(a Value, b Value) bool {
 		return true
 	case VAL_NUMBER:
 		return AsNumber(a) == AsNumber(b)
+	case VAL_OBJ:
+		return a.obj == b.obj
 	default:
 		return false
 	}
 }
+
+// stringsEqual compares two strings without flattening either, so a loop
+// that compares a string it keeps appending to doesn't copy it each time.
+func stringsEqual(a Value, b Value) bool {
+	switch {
+	case IsObjType(a, OBJ_STRING) && IsObjType(b, OBJ_STRING):
+		x, y := AsObjString(a), AsObjString(b)
+		if x.flat && y.flat {
+			return x.handle == y.handle
+		}
+		return bytes.Equal(x.contents(), y.contents())
+	case IsObjType(a, OBJ_STRING):
+		return string(AsObjString(a).contents()) == b.String
+	case IsObjType(b, OBJ_STRING):
+		return a.String == string(AsObjString(b).contents())
+	default:
+		return a.String == b.String
+	}
+}
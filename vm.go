@@ -2,12 +2,24 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 )
 
 type InterpretResult int
 
-const STACK_MAX = 256
+const FRAMES_MAX = 64
+const FRAME_SLOTS = 256
+const STACK_MAX = FRAMES_MAX * FRAME_SLOTS
+
+// TIME_SLICE is how many times a thread loops before it lets the others
+// have a turn.
+const TIME_SLICE = 1000
 
 const (
 	INTERPRET_OK = iota
@@ -15,52 +27,1043 @@ const (
 	INTERPRET_RUNTIME_ERROR
 )
 
+// CallFrame is a function call in progress. Slots is where its window of
+// the stack starts: the callee, then its arguments and locals. Ip is saved
+// here while the frame is calling another; the running frame's is vm.Ip.
+// A frame resuming a generator has it in Generator, and DoneIp, unless it
+// is -1, is where the caller carries on if the generator returns.
+type CallFrame struct {
+	Closure   *ObjClosure
+	Ip        int
+	Slots     int
+	Generator *ObjGenerator
+	DoneIp    int
+}
+
+// Fiber is a thread of execution: a stack of call frames and the stack of
+// values they use.
+type Fiber struct {
+	Frames       [FRAMES_MAX]CallFrame
+	FrameCount   int
+	Ip           int
+	Stack        []Value
+	Sp           int
+	OpenUpvalues *ObjUpvalue
+}
+
 type VM struct {
-	Chunk       Chunk
+	// The running fiber's state, which vm.Stack, vm.Frames and the rest
+	// refer to. Switching fibers just points it at another's.
+	*Fiber
+	Running *ObjFiber
+	Root    *ObjFiber // the fiber the script starts in
+	// Switch is the fiber a native has asked to switch to, handing it the
+	// native's result.
+	Switch      *ObjFiber
+	Chunk       *Chunk
 	Instruction []uint8
-	Ip          int
-	Stack       []Value
-	Sp          int
-	Globals     map[string]Value
+	Globals     map[string]Value // those of the running frame's module
+	// Main is the module the script runs in. Modules holds every module
+	// imported so far by resolved path, so each is only loaded once.
+	Main    *ObjModule
+	Modules map[string]*ObjModule
+	// Exception is the value being thrown, and Trace the stack trace from
+	// where it was thrown.
+	Exception Value
+	Trace     []string
+	// Scheduler is shared by all the threads, which take turns holding
+	// its lock. A thread lets go of it while it waits on a channel or
+	// another thread, and after every TIME_SLICE loops, counted in Ticks.
+	Scheduler *Scheduler
+	Ticks     int
+	// Result is what the thread's function returned, once it has.
+	Result Value
 }
 
 func (vm *VM) InitVM() {
-	vm.Stack = make([]Value, STACK_MAX)
+	vm.Root = newFiber(nil)
+	vm.setFiber(vm.Root)
 	vm.resetStack()
-	vm.Globals = make(map[string]Value)
+	vm.Main = newModule("", "")
+	vm.Globals = vm.Main.Globals
+	vm.Modules = make(map[string]*ObjModule)
+	vm.Scheduler = &Scheduler{Runnable: 1, Main: vm}
+}
+
+// SetScriptPath records the file the script was read from, for imports to
+// resolve against and so that importing it back is caught as a cycle.
+func (vm *VM) SetScriptPath(path string) {
+	vm.Main.Name = filepath.Base(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		vm.Main.Path = abs
+		vm.Modules[abs] = vm.Main
+	}
 }
 
 func (vm *VM) resetStack() {
 	vm.Sp = 0
+	vm.FrameCount = 0
+	vm.OpenUpvalues = nil
 }
 
+// runtimeError throws an error object for a fault the VM detected. The
+// caller then makes the VM return INTERPRET_RUNTIME_ERROR, as after any
+// throw, for catch to find a handler.
 func (vm *VM) runtimeError(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, args...)
-	fmt.Fprintln(os.Stderr)
+	vm.throw(NilVal())
+	vm.Exception = ObjVal(newError(fmt.Sprintf(format, args...), vm.Trace))
+}
 
-	instruction := vm.Ip
-	var line int
-	if instruction >= 0 && instruction < len(vm.Chunk.Lines) {
-		line = vm.Chunk.Lines[instruction]
-	} else {
-		line = -1
+func (vm *VM) throw(value Value) {
+	vm.Exception = value
+	vm.Trace = vm.stackTrace()
+}
+
+// stackTrace describes the active calls, innermost first.
+func (vm *VM) stackTrace() []string {
+	var trace []string
+	for i := vm.FrameCount - 1; i >= 0; i-- {
+		frame := &vm.Frames[i]
+		function := frame.Closure.Function
+		instruction := frame.Ip
+		if i == vm.FrameCount-1 {
+			instruction = vm.Ip
+		}
+		var line int
+		if function.Registers != nil {
+			line = function.Registers.GetLine(instruction - 1)
+		} else {
+			line = function.Chunk.GetLine(instruction - 1)
+		}
+
+		if function.Module != vm.Main && function == function.Module.Script {
+			trace = append(trace, fmt.Sprintf("[line %d] in module '%s'", line, function.Module.Name))
+		} else if function == function.Module.Script {
+			trace = append(trace, fmt.Sprintf("[line %d] in script", line))
+		} else {
+			trace = append(trace, fmt.Sprintf("[line %d] in %s", line, functionName(function)))
+		}
+	}
+	return trace
+}
+
+// catch unwinds the stack to the innermost handler for the exception being
+// thrown and reports whether there was one to resume at. An uncaught
+// exception is reported and ends the script.
+func (vm *VM) catch() bool {
+	ip := vm.Ip
+	for vm.FrameCount > 0 {
+		frame := vm.frame()
+		function := frame.Closure.Function
+		handlers := function.Chunk.Handlers
+		if function.Registers != nil {
+			handlers = function.Registers.Handlers
+		}
+		for _, handler := range handlers {
+			if ip-1 >= handler.Start && ip-1 < handler.End {
+				vm.closeUpvalues(frame.Slots + handler.Depth)
+				vm.Sp = frame.Slots + handler.Depth
+				vm.push(vm.Exception)
+				vm.Ip = handler.Target
+				return true
+			}
+		}
+
+		vm.closeUpvalues(frame.Slots)
+		if frame.Generator != nil {
+			frame.Generator.State = GENERATOR_DONE
+		}
+		if function == function.Module.Script {
+			// A module whose top-level code threw is not loaded, so a
+			// later import tries again.
+			delete(vm.Modules, function.Module.Path)
+		}
+		vm.FrameCount--
+		if vm.FrameCount > 0 {
+			ip = vm.frame().Ip
+			continue
+		}
+
+		// Nothing in the fiber caught it, so the fiber dies and the
+		// exception goes on to the fiber that called it, if any.
+		fiber := vm.Running
+		fiber.State = FIBER_DONE
+		fiber.Error = vm.Exception
+		if caller := fiber.Caller; caller != nil {
+			fiber.Caller = nil
+			if fiber.Trying {
+				vm.switchFiber(caller, vm.Exception, 0)
+				return true
+			}
+			vm.switchFiber(caller, NilVal(), 0)
+			ip = vm.Ip
+		}
 	}
 
-	fmt.Fprintf(os.Stderr, "[line %d] in script\n", line)
+	trace := vm.Trace
+	if IsObjType(vm.Exception, OBJ_ERROR) {
+		fmt.Fprintln(os.Stderr, AsError(vm.Exception).Message)
+		trace = AsError(vm.Exception).Trace
+	} else {
+		fmt.Fprintf(os.Stderr, "Uncaught exception: %s\n", toString(vm.Exception))
+	}
+	for _, line := range trace {
+		fmt.Fprintln(os.Stderr, line)
+	}
 	vm.resetStack()
+	return false
 }
-func (vm *VM) Interpret(source string) InterpretResult {
-	var chunk Chunk
-	chunk.InitChunk()
 
-	if !Compile(source, &chunk) {
-		return INTERPRET_COMPILE_ERROR
+func (vm *VM) frame() *CallFrame {
+	return &vm.Frames[vm.FrameCount-1]
+}
+
+// loadFrame points the stack machine at the code and globals of the
+// running frame.
+func (vm *VM) loadFrame() *CallFrame {
+	frame := vm.frame()
+	vm.Chunk = &frame.Closure.Function.Chunk
+	vm.Instruction = vm.Chunk.Code
+	vm.Globals = frame.Closure.Function.Module.Globals
+	return frame
+}
+
+// callValue calls callee with the argCount arguments above it, where
+// callee sits in stack slot base. The last len(names) arguments are
+// keyword arguments with those names. A closure gets a new frame, which
+// the caller then starts running; a native runs at once and leaves its
+// result in slot base, unless it switched fibers.
+func (vm *VM) callValue(callee Value, argCount int, names []Value, base int) bool {
+	if IsObj(callee) {
+		switch OBJ_TYPE(callee) {
+		case OBJ_CLOSURE:
+			return vm.call(AsClosure(callee), argCount, names, base)
+		case OBJ_NATIVE:
+			native := AsNative(callee)
+			if len(names) > 0 {
+				vm.runtimeError("Unknown parameter '%s'.", AsString(names[0]))
+				return false
+			}
+			if argCount != native.Arity {
+				vm.runtimeError("Expected %d arguments but got %d.", native.Arity, argCount)
+				return false
+			}
+			result, ok := native.Fn(vm, vm.Stack[base+1:base+1+argCount])
+			if !ok {
+				return false
+			}
+			if fiber := vm.Switch; fiber != nil {
+				vm.Switch = nil
+				return vm.switchFiber(fiber, result, base)
+			}
+			vm.Stack[base] = result
+			vm.Sp = base + 1
+			return true
+		}
+	}
+	vm.runtimeError("Can only call functions and classes.")
+	return false
+}
+
+func (vm *VM) call(closure *ObjClosure, argCount int, names []Value, base int) bool {
+	vm.ensureStack(base + FRAME_SLOTS)
+	if !vm.bindArguments(closure.Function, argCount, names, base) {
+		return false
+	}
+	if closure.Function.Generator {
+		// The body only runs once the generator is resumed.
+		slots := append([]Value{}, vm.Stack[base:base+1+closure.Function.Arity]...)
+		vm.Stack[base] = ObjVal(newGenerator(closure, slots))
+		vm.Sp = base + 1
+		return true
+	}
+	if vm.FrameCount == FRAMES_MAX {
+		vm.runtimeError("Stack overflow.")
+		return false
 	}
 
-	vm.Chunk = chunk
+	if vm.FrameCount > 0 {
+		vm.frame().Ip = vm.Ip
+	}
+	frame := &vm.Frames[vm.FrameCount]
+	vm.FrameCount++
+	frame.Closure = closure
+	frame.Ip = 0
+	frame.Slots = base
+	frame.Generator = nil
 	vm.Ip = 0
-	vm.Instruction = vm.Chunk.Code
-	return vm.run()
+	return true
+}
+
+// resume carries on running a suspended generator in a new frame at base,
+// putting back the slots and upvalues it saved when it yielded.
+func (vm *VM) resume(generator *ObjGenerator, base int, doneIp int) bool {
+	if generator.State == GENERATOR_RUNNING {
+		vm.runtimeError("Generator is already running.")
+		return false
+	}
+	if vm.FrameCount == FRAMES_MAX {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	vm.ensureStack(base + FRAME_SLOTS)
+	vm.frame().Ip = vm.Ip
+	frame := &vm.Frames[vm.FrameCount]
+	vm.FrameCount++
+	frame.Closure = generator.Closure
+	frame.Slots = base
+	frame.Generator = generator
+	frame.DoneIp = doneIp
+	copy(vm.Stack[base:], generator.Stack)
+	vm.Sp = base + len(generator.Stack)
+	// The saved upvalues are above any still open, so they go on the front
+	// of the list, keeping it in order.
+	for i := len(generator.Upvalues) - 1; i >= 0; i-- {
+		upvalue := generator.Upvalues[i]
+		upvalue.Slot += base
+		upvalue.Location = &vm.Stack[upvalue.Slot]
+		upvalue.Next = vm.OpenUpvalues
+		vm.OpenUpvalues = upvalue
+	}
+	generator.Upvalues = generator.Upvalues[:0]
+	generator.State = GENERATOR_RUNNING
+	vm.Ip = generator.Ip
+	return true
+}
+
+// yield suspends the generator running in frame, saving the first size
+// slots of its window, and leaves value in the caller's slot. Upvalues
+// still open on those slots move with them, so closures share the saved
+// variables with the generator.
+func (vm *VM) yield(frame *CallFrame, size int, value Value) {
+	generator := frame.Generator
+	generator.Stack = append(generator.Stack[:0], vm.Stack[frame.Slots:frame.Slots+size]...)
+	generator.Ip = vm.Ip
+	for vm.OpenUpvalues != nil && vm.OpenUpvalues.Slot >= frame.Slots {
+		upvalue := vm.OpenUpvalues
+		vm.OpenUpvalues = upvalue.Next
+		upvalue.Slot -= frame.Slots
+		upvalue.Location = &generator.Stack[upvalue.Slot]
+		upvalue.Next = nil
+		generator.Upvalues = append(generator.Upvalues, upvalue)
+	}
+	generator.State = GENERATOR_SUSPENDED
+	vm.FrameCount--
+	vm.Stack[frame.Slots] = value
+}
+
+// iterateGenerator steps a for-in loop over a generator, resuming it with
+// its frame where the item goes. When the generator has finished, the
+// item is nil and the loop carries on at doneIp.
+func (vm *VM) iterateGenerator(generator *ObjGenerator, base int, doneIp int) bool {
+	if generator.State == GENERATOR_DONE {
+		vm.Stack[base] = NilVal()
+		vm.Sp = base + 1
+		vm.Ip = doneIp
+		return true
+	}
+	return vm.resume(generator, base, doneIp)
+}
+
+// invokeFrame handles the invocations that run code in a new frame rather
+// than a native method: calling a function a module exports, and a
+// generator's next(). handled is false for any other invocation.
+func (vm *VM) invokeFrame(name string, argCount int, base int) (handled bool, ok bool) {
+	receiver := vm.Stack[base]
+	switch {
+	case IsObjType(receiver, OBJ_MODULE):
+		callee, ok := vm.getProperty(receiver, name)
+		return true, ok && vm.callValue(callee, argCount, nil, base)
+	case IsObjType(receiver, OBJ_GENERATOR) && name == "next":
+		if argCount != 0 {
+			vm.runtimeError("Expected 0 arguments but got %d.", argCount)
+			return true, false
+		}
+		generator := AsGenerator(receiver)
+		if generator.State == GENERATOR_DONE {
+			vm.Stack[base] = NilVal()
+			return true, true
+		}
+		return true, vm.resume(generator, base, -1)
+	case IsObjType(receiver, OBJ_FIBER) && (name == "call" || name == "try" || name == "transfer"):
+		if argCount > 1 {
+			vm.runtimeError("Expected 0 to 1 arguments but got %d.", argCount)
+			return true, false
+		}
+		value := NilVal()
+		if argCount == 1 {
+			value = vm.Stack[base+1]
+		}
+		if name == "transfer" {
+			return true, vm.transferFiber(AsFiber(receiver), value, base)
+		}
+		return true, vm.callFiber(AsFiber(receiver), value, base, name == "try")
+	}
+	return false, true
+}
+
+// callFiber runs fiber until it yields or finishes, handing the running
+// fiber what it yielded or returned in slot base. When trying, an error
+// that kills fiber is handed back the same way instead of being rethrown.
+func (vm *VM) callFiber(fiber *ObjFiber, value Value, base int, trying bool) bool {
+	if !vm.checkResumable(fiber) {
+		return false
+	}
+	if fiber.Caller != nil {
+		vm.runtimeError("Fiber has already been called.")
+		return false
+	}
+	fiber.Caller = vm.Running
+	fiber.Trying = trying
+	return vm.switchFiber(fiber, value, base)
+}
+
+// transferFiber switches to fiber without making it return to the running
+// one, which is suspended until something switches back to it.
+func (vm *VM) transferFiber(fiber *ObjFiber, value Value, base int) bool {
+	if !vm.checkResumable(fiber) {
+		return false
+	}
+	vm.Running.State = FIBER_SUSPENDED
+	return vm.switchFiber(fiber, value, base)
+}
+
+func (vm *VM) checkResumable(fiber *ObjFiber) bool {
+	switch fiber.State {
+	case FIBER_RUNNING:
+		vm.runtimeError("Fiber is already running.")
+		return false
+	case FIBER_DONE:
+		vm.runtimeError("Can't resume a finished fiber.")
+		return false
+	}
+	return true
+}
+
+// switchFiber leaves the running fiber, which gets the value it is later
+// resumed with in slot base, and resumes fiber with value. A new fiber
+// starts by calling its function with value, if it takes a parameter.
+func (vm *VM) switchFiber(fiber *ObjFiber, value Value, base int) bool {
+	vm.Running.Result = base
+	vm.setFiber(fiber)
+	state := fiber.State
+	fiber.State = FIBER_RUNNING
+	if state == FIBER_NEW {
+		closure := fiber.Closure
+		vm.push(ObjVal(closure))
+		if closure.Function.Arity == 1 {
+			vm.push(value)
+		}
+		return vm.call(closure, closure.Function.Arity, nil, 0)
+	}
+	vm.Stack[fiber.Result] = value
+	vm.Sp = fiber.Result + 1
+	return true
+}
+
+// finishFiber ends the running fiber, whose function returned result, and
+// goes back to the fiber that called it. It returns false when there is
+// none to go back to, and the script is over.
+func (vm *VM) finishFiber(result Value) bool {
+	fiber := vm.Running
+	fiber.State = FIBER_DONE
+	caller := fiber.Caller
+	if caller == nil {
+		vm.Result = result
+		return false
+	}
+	fiber.Caller = nil
+	return vm.switchFiber(caller, result, 0)
+}
+
+// spawn starts the call of the closure in slot base, with the argCount
+// arguments above it, on a new thread, and leaves the thread in slot base.
+// The last of the arguments are keyword arguments, one for each of names.
+// The thread gets a VM of its own, sharing this one's modules and
+// scheduler.
+func (vm *VM) spawn(argCount int, names []Value, base int) bool {
+	callee := vm.Stack[base]
+	if !IsObjType(callee, OBJ_CLOSURE) {
+		vm.runtimeError("Can only spawn functions.")
+		return false
+	}
+	worker := &VM{Main: vm.Main, Modules: vm.Modules, Scheduler: vm.Scheduler, Result: NilVal()}
+	worker.Root = newFiber(nil)
+	worker.Root.State = FIBER_RUNNING
+	worker.setFiber(worker.Root)
+	for _, value := range vm.Stack[base : base+1+argCount] {
+		worker.push(value)
+	}
+	if !worker.call(AsClosure(callee), argCount, names, 0) {
+		// The arguments don't suit the function, which is this thread's
+		// error to report.
+		vm.runtimeError("%s", AsError(worker.Exception).Message)
+		return false
+	}
+
+	thread := newThread()
+	if worker.FrameCount == 0 {
+		// Calling a generator function just makes the generator.
+		thread.Result = worker.Stack[0]
+		thread.Done = true
+	} else {
+		vm.Scheduler.Runnable++
+		go worker.runThread(thread)
+	}
+	vm.Stack[base] = ObjVal(thread)
+	vm.Sp = base + 1
+	return true
+}
+
+// runThread runs a spawned call to the end, taking turns with the other
+// threads to hold the lock. An exception it doesn't catch is reported as
+// one in the script would be, but ends only this thread.
+func (vm *VM) runThread(thread *ObjThread) {
+	vm.Scheduler.Lock()
+	defer vm.Scheduler.Unlock()
+	for {
+		result := vm.execute()
+		if result != INTERPRET_RUNTIME_ERROR || !vm.catch() {
+			break
+		}
+	}
+	thread.Result = vm.Result
+	thread.Done = true
+	for _, joiner := range thread.Joiners {
+		if !joiner.Woken {
+			vm.Scheduler.wake(joiner)
+		}
+	}
+	thread.Joiners = nil
+	vm.Scheduler.Runnable--
+	if vm.Scheduler.Runnable == 0 {
+		// The script's own thread is waiting, and this was the last one
+		// that could have woken it.
+		waiter := vm.Scheduler.MainWaiter
+		waiter.Deadlocked = true
+		vm.Scheduler.wake(waiter)
+	}
+}
+
+// Scheduler is what a script's threads share to take turns. Each thread
+// has a VM of its own, but they share globals and heap objects, so only
+// the thread holding the lock runs. Runnable counts the threads that
+// aren't waiting for another to wake them, and is only changed holding
+// the lock, so a thread about to wait can tell when nothing ever would.
+// Main is the VM that runs the script, and MainWaiter its waiter while it
+// waits.
+type Scheduler struct {
+	sync.Mutex
+	Runnable   int
+	Main       *VM
+	MainWaiter *Waiter
+}
+
+// Waiter is a thread blocked on a channel or on another thread, until the
+// thread that can let it go closes Wake. A waiting sender's value is in
+// Value; a receiver is handed one there, with Ok false if the channel was
+// closed instead, and Channel set to the channel that woke it. A waiter
+// is Deadlocked if it was woken because nothing else ever would.
+type Waiter struct {
+	Wake       chan struct{}
+	Woken      bool
+	Deadlocked bool
+	Value      Value
+	Ok         bool
+	Channel    *ObjChannel
+}
+
+func newWaiter() *Waiter {
+	return &Waiter{Wake: make(chan struct{}), Value: NilVal()}
+}
+
+// wake lets a waiting thread go. It counts as runnable from here on, not
+// from when it next gets the lock, so it is never taken for deadlocked.
+func (scheduler *Scheduler) wake(waiter *Waiter) {
+	waiter.Woken = true
+	scheduler.Runnable++
+	close(waiter.Wake)
+}
+
+// canWait reports whether some other thread could still wake this one if
+// it waited, and throws an error if none could.
+func (vm *VM) canWait() bool {
+	if vm.Scheduler.Runnable == 1 {
+		vm.deadlock()
+		return false
+	}
+	return true
+}
+
+func (vm *VM) deadlock() {
+	vm.runtimeError("Deadlock: all threads are blocked.")
+}
+
+// wait blocks until another thread wakes waiter, letting go of the lock
+// meanwhile. It throws if the threads that could have woken it all ended
+// instead.
+func (vm *VM) wait(waiter *Waiter) bool {
+	scheduler := vm.Scheduler
+	scheduler.Runnable--
+	if vm == scheduler.Main {
+		scheduler.MainWaiter = waiter
+	}
+	scheduler.Unlock()
+	<-waiter.Wake
+	scheduler.Lock()
+	if vm == scheduler.Main {
+		scheduler.MainWaiter = nil
+	}
+	if waiter.Deadlocked {
+		vm.deadlock()
+		return false
+	}
+	return true
+}
+
+// nextWaiter takes the first thread off queue that is still waiting. A
+// select waits on several channels, and may have been woken by another.
+func nextWaiter(queue *[]*Waiter) *Waiter {
+	for len(*queue) > 0 {
+		waiter := (*queue)[0]
+		*queue = (*queue)[1:]
+		if !waiter.Woken {
+			return waiter
+		}
+	}
+	return nil
+}
+
+// send puts value on channel, waiting while the channel is full and no
+// thread is waiting to receive.
+func (vm *VM) send(channel *ObjChannel, value Value) bool {
+	if channel.Closed {
+		vm.runtimeError("Can't send on a closed channel.")
+		return false
+	}
+	if receiver := nextWaiter(&channel.Receivers); receiver != nil {
+		receiver.Value, receiver.Ok, receiver.Channel = value, true, channel
+		vm.Scheduler.wake(receiver)
+		return true
+	}
+	if len(channel.Buffer) < channel.Capacity {
+		channel.Buffer = append(channel.Buffer, value)
+		return true
+	}
+	if !vm.canWait() {
+		return false
+	}
+	sender := newWaiter()
+	sender.Value = value
+	channel.Senders = append(channel.Senders, sender)
+	if !vm.wait(sender) {
+		return false
+	}
+	if !sender.Ok {
+		// Another thread closed the channel while this one waited.
+		vm.runtimeError("Can't send on a closed channel.")
+		return false
+	}
+	return true
+}
+
+// tryReceive takes a value from channel if one is there to take. ready is
+// false if receiving would have to wait, and more is false once the
+// channel is closed and has no values left.
+func (vm *VM) tryReceive(channel *ObjChannel) (value Value, more bool, ready bool) {
+	if len(channel.Buffer) > 0 {
+		value = channel.Buffer[0]
+		channel.Buffer = channel.Buffer[1:]
+		// The first waiting sender's value takes the place it freed.
+		if sender := nextWaiter(&channel.Senders); sender != nil {
+			channel.Buffer = append(channel.Buffer, sender.Value)
+			sender.Ok = true
+			vm.Scheduler.wake(sender)
+		}
+		return value, true, true
+	}
+	if sender := nextWaiter(&channel.Senders); sender != nil {
+		sender.Ok = true
+		vm.Scheduler.wake(sender)
+		return sender.Value, true, true
+	}
+	if channel.Closed {
+		return NilVal(), false, true
+	}
+	return NilVal(), false, false
+}
+
+// receive waits for a value sent on channel. more is false, with a nil
+// value, once the channel is closed and has no values left.
+func (vm *VM) receive(channel *ObjChannel) (value Value, more bool, ok bool) {
+	if value, more, ready := vm.tryReceive(channel); ready {
+		return value, more, true
+	}
+	if !vm.canWait() {
+		return NilVal(), false, false
+	}
+	receiver := newWaiter()
+	channel.Receivers = append(channel.Receivers, receiver)
+	if !vm.wait(receiver) {
+		return NilVal(), false, false
+	}
+	return receiver.Value, receiver.Ok, true
+}
+
+// selectChannels waits for whichever of channels is first to have a value
+// or be closed, preferring earlier ones if several already do, and
+// returns that channel's index with the value received.
+func (vm *VM) selectChannels(channels []*ObjChannel) (int, Value, bool) {
+	for i, channel := range channels {
+		if value, _, ready := vm.tryReceive(channel); ready {
+			return i, value, true
+		}
+	}
+	if !vm.canWait() {
+		return 0, NilVal(), false
+	}
+	receiver := newWaiter()
+	for _, channel := range channels {
+		channel.Receivers = append(channel.Receivers, receiver)
+	}
+	waited := vm.wait(receiver)
+	for _, channel := range channels {
+		channel.Receivers = slices.DeleteFunc(channel.Receivers, func(waiter *Waiter) bool {
+			return waiter == receiver
+		})
+	}
+	if !waited {
+		return 0, NilVal(), false
+	}
+	return slices.Index(channels, receiver.Channel), receiver.Value, true
+}
+
+// closeChannel closes channel, letting go every thread waiting on it.
+// Receivers get nil; senders throw.
+func (vm *VM) closeChannel(channel *ObjChannel) bool {
+	if channel.Closed {
+		vm.runtimeError("Channel is already closed.")
+		return false
+	}
+	channel.Closed = true
+	for receiver := nextWaiter(&channel.Receivers); receiver != nil; receiver = nextWaiter(&channel.Receivers) {
+		receiver.Channel = channel
+		vm.Scheduler.wake(receiver)
+	}
+	for sender := nextWaiter(&channel.Senders); sender != nil; sender = nextWaiter(&channel.Senders) {
+		vm.Scheduler.wake(sender)
+	}
+	return true
+}
+
+// join waits for thread to finish.
+func (vm *VM) join(thread *ObjThread) bool {
+	if thread.Done {
+		return true
+	}
+	if !vm.canWait() {
+		return false
+	}
+	joiner := newWaiter()
+	thread.Joiners = append(thread.Joiners, joiner)
+	return vm.wait(joiner)
+}
+
+// tick counts a loop, giving the other threads a turn once every
+// TIME_SLICE.
+func (vm *VM) tick() {
+	vm.Ticks++
+	if vm.Ticks < TIME_SLICE {
+		return
+	}
+	vm.Ticks = 0
+	vm.Scheduler.Unlock()
+	runtime.Gosched()
+	vm.Scheduler.Lock()
+}
+
+func (vm *VM) setFiber(fiber *ObjFiber) {
+	vm.Running = fiber
+	vm.Fiber = &fiber.Fiber
+}
+
+// ensureStack grows the running fiber's stack to at least size slots,
+// moving the open upvalues that point into it. Only calls grow it, so the
+// register machine's view of the stack is reloaded after.
+func (vm *VM) ensureStack(size int) {
+	if size <= len(vm.Stack) {
+		return
+	}
+	grown := len(vm.Stack)
+	for grown < size {
+		grown *= 2
+	}
+	stack := make([]Value, grown)
+	copy(stack, vm.Stack)
+	vm.Stack = stack
+	for upvalue := vm.OpenUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		upvalue.Location = &vm.Stack[upvalue.Slot]
+	}
+}
+
+// bindArguments puts each argument in the slot of the parameter it is
+// for. Parameters nobody passed get an absent value for their default to
+// replace, and a variadic function's surplus arguments become a list.
+func (vm *VM) bindArguments(function *ObjFunction, argCount int, names []Value, base int) bool {
+	positional := argCount - len(names)
+	fixed := function.Arity
+	if function.Variadic {
+		fixed--
+	} else if positional > fixed {
+		if function.Required == fixed {
+			vm.runtimeError("Expected %d arguments but got %d.", fixed, positional)
+		} else {
+			vm.runtimeError("Expected %d to %d arguments but got %d.", function.Required, fixed, positional)
+		}
+		return false
+	}
+	if len(names) == 0 && positional == function.Arity && !function.Variadic {
+		return true
+	}
+
+	keywords := append([]Value{}, vm.Stack[base+1+positional:base+1+argCount]...)
+	rest := []Value{}
+	if positional > fixed {
+		rest = append(rest, vm.Stack[base+1+fixed:base+1+positional]...)
+		positional = fixed
+	}
+	params := vm.Stack[base+1 : base+1+function.Arity]
+	for i := positional; i < fixed; i++ {
+		params[i] = AbsentVal()
+	}
+	if function.Variadic {
+		params[fixed] = ObjVal(newList(rest))
+	}
+	for i, name := range names {
+		param := slices.Index(function.Params[:fixed], AsString(name))
+		if param == -1 {
+			vm.runtimeError("Unknown parameter '%s'.", AsString(name))
+			return false
+		}
+		if !IsAbsent(params[param]) {
+			vm.runtimeError("Got more than one value for parameter '%s'.", AsString(name))
+			return false
+		}
+		params[param] = keywords[i]
+	}
+
+	var missing []string
+	for i := 0; i < function.Required; i++ {
+		if IsAbsent(params[i]) {
+			missing = append(missing, "'"+function.Params[i]+"'")
+		}
+	}
+	if len(missing) == 1 {
+		vm.runtimeError("Missing argument for parameter %s.", missing[0])
+		return false
+	} else if len(missing) > 1 {
+		vm.runtimeError("Missing arguments for parameters %s.", strings.Join(missing, ", "))
+		return false
+	}
+	vm.Sp = base + 1 + function.Arity
+	return true
+}
+
+// extend appends the elements of a spread argument to the list of
+// positional arguments gathered so far.
+func (vm *VM) extend(args Value, spread Value) bool {
+	if !IsObjType(spread, OBJ_LIST) {
+		vm.runtimeError("Only lists can be spread.")
+		return false
+	}
+	list := AsList(args)
+	list.Items = append(list.Items, AsList(spread).Items...)
+	return true
+}
+
+// spreadArguments replaces the list of positional arguments above the
+// callee in slot base with its elements, moving the keywordCount keyword
+// arguments after it up to follow them. It returns the argument count.
+func (vm *VM) spreadArguments(base int, keywordCount int) (int, bool) {
+	items := AsList(vm.Stack[base+1]).Items
+	argCount := len(items) + keywordCount
+	if base+1+argCount > STACK_MAX {
+		vm.runtimeError("Stack overflow.")
+		return 0, false
+	}
+	vm.ensureStack(base + 1 + argCount)
+	keywords := append([]Value{}, vm.Stack[base+2:base+2+keywordCount]...)
+	copy(vm.Stack[base+1:], items)
+	copy(vm.Stack[base+1+len(items):], keywords)
+	vm.Sp = base + 1 + argCount
+	return argCount, true
+}
+
+// captureUpvalue returns the upvalue for stack slot, reusing the open one
+// if another closure already captured it.
+func (vm *VM) captureUpvalue(slot int) *ObjUpvalue {
+	var prev *ObjUpvalue
+	upvalue := vm.OpenUpvalues
+	for upvalue != nil && upvalue.Slot > slot {
+		prev = upvalue
+		upvalue = upvalue.Next
+	}
+	if upvalue != nil && upvalue.Slot == slot {
+		return upvalue
+	}
+
+	created := newUpvalue(&vm.Stack[slot], slot)
+	created.Next = upvalue
+	if prev == nil {
+		vm.OpenUpvalues = created
+	} else {
+		prev.Next = created
+	}
+	return created
+}
+
+// closeUpvalues moves every variable captured from slot last or above off
+// the stack.
+func (vm *VM) closeUpvalues(last int) {
+	for vm.OpenUpvalues != nil && vm.OpenUpvalues.Slot >= last {
+		upvalue := vm.OpenUpvalues
+		upvalue.Closed = *upvalue.Location
+		upvalue.Location = &upvalue.Closed
+		vm.OpenUpvalues = upvalue.Next
+	}
+}
+
+// newClosureFrom builds the closure for function, capturing its upvalues
+// from the frame creating it as each (isLocal, index) pair in captures
+// says.
+func (vm *VM) newClosureFrom(function *ObjFunction, frame *CallFrame, captures func() (bool, int)) *ObjClosure {
+	closure := newClosure(function)
+	for i := range closure.Upvalues {
+		isLocal, index := captures()
+		if isLocal {
+			closure.Upvalues[i] = vm.captureUpvalue(frame.Slots + index)
+		} else {
+			closure.Upvalues[i] = frame.Closure.Upvalues[index]
+		}
+	}
+	return closure
+}
+
+// defineGlobal binds name in the running frame's module, as a constant if
+// constant is set. A constant can't be defined over, even from a later
+// chunk the compiler could not check against this one.
+func (vm *VM) defineGlobal(name string, value Value, constant bool) bool {
+	module := vm.frame().Closure.Function.Module
+	if module.Constants[name] {
+		vm.runtimeError("Cannot assign to constant '%s'.", name)
+		return false
+	}
+	vm.Globals[name] = value
+	if constant {
+		module.Constants[name] = true
+	}
+	return true
+}
+
+// importModule puts the module an import names into slot base. A module
+// not yet loaded is compiled and its top-level code called with base as
+// its frame; returning from that leaves the module in the slot.
+func (vm *VM) importModule(name string, base int) bool {
+	path := name
+	if filepath.Ext(path) == "" {
+		path += ".lox"
+	}
+	if !filepath.IsAbs(path) {
+		importer := vm.frame().Closure.Function.Module
+		path = filepath.Join(filepath.Dir(importer.Path), path)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	if module, ok := vm.Modules[path]; ok {
+		if !module.Loaded {
+			vm.runtimeError("Import cycle: %s.", vm.importChain(module))
+			return false
+		}
+		vm.Stack[base] = ObjVal(module)
+		return true
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		vm.runtimeError("Could not read module '%s'.", name)
+		return false
+	}
+	module := newModule(name, path)
+	module.Script = Compile(string(source), module)
+	if module.Script == nil {
+		vm.runtimeError("Could not compile module '%s'.", name)
+		return false
+	}
+	closure := newClosure(module.Script)
+	vm.Stack[base] = ObjVal(closure)
+	if !vm.call(closure, 0, nil, base) {
+		return false
+	}
+	vm.Modules[path] = module
+	return true
+}
+
+// importChain names the modules from module to the one importing it
+// again, each of which is still running its top-level code.
+func (vm *VM) importChain(module *ObjModule) string {
+	var names []string
+	for i := 0; i < vm.FrameCount; i++ {
+		function := vm.Frames[i].Closure.Function
+		if function == function.Module.Script && (names != nil || function.Module == module) {
+			names = append(names, function.Module.Name)
+		}
+	}
+	return strings.Join(append(names, module.Name), " -> ")
+}
+
+// returnValue is what a frame leaves in its caller's slot once it has
+// been popped: result, or for a module's top-level code the module, now
+// loaded. A generator that returns is finished and leaves nil.
+func (vm *VM) returnValue(frame *CallFrame, result Value) Value {
+	if generator := frame.Generator; generator != nil {
+		generator.State = GENERATOR_DONE
+		if frame.DoneIp != -1 {
+			vm.frame().Ip = frame.DoneIp
+		}
+		return NilVal()
+	}
+	function := frame.Closure.Function
+	if module := function.Module; function == module.Script {
+		module.Loaded = true
+		return ObjVal(module)
+	}
+	return result
+}
+
+func (vm *VM) Interpret(source string) InterpretResult {
+	function := Compile(source, vm.Main)
+	if function == nil {
+		return INTERPRET_COMPILE_ERROR
+	}
+	vm.Main.Script = function
+
+	vm.Scheduler.Lock()
+	defer vm.Scheduler.Unlock()
+	vm.setFiber(vm.Root)
+	vm.Root.State = FIBER_RUNNING
+	vm.resetStack()
+	closure := newClosure(function)
+	vm.push(ObjVal(closure))
+	vm.call(closure, 0, nil, 0)
+	for {
+		result := vm.execute()
+		if result != INTERPRET_RUNTIME_ERROR || !vm.catch() {
+			return result
+		}
+	}
 }
 
 func (vm *VM) DEBUG_TRACE_EXECUTION() {
@@ -75,10 +1078,11 @@ func (vm *VM) DEBUG_TRACE_EXECUTION() {
 }
 
 func (vm *VM) run() InterpretResult {
+	frame := vm.loadFrame()
 	for {
 		//vm.DEBUG_TRACE_EXECUTION() // Comment
 
-		switch vm.READ_BYTE() {
+		switch instruction := vm.READ_BYTE(); instruction {
 		case OP_CONSTANT:
 			constant := vm.READ_CONSTANT()
 			vm.push(constant)
@@ -90,12 +1094,22 @@ func (vm *VM) run() InterpretResult {
 			vm.push(BoolVal(false))
 		case OP_POP:
 			vm.pop()
+		case OP_DUP:
+			vm.push(vm.peek(0))
+		case OP_DUP2:
+			vm.push(vm.peek(1))
+			vm.push(vm.peek(1))
+		case OP_BURY:
+			depth := int(vm.READ_BYTE())
+			top := vm.peek(0)
+			copy(vm.Stack[vm.Sp-depth:vm.Sp], vm.Stack[vm.Sp-depth-1:vm.Sp-1])
+			vm.Stack[vm.Sp-depth-1] = top
 		case OP_GET_LOCAL:
-			slot := vm.READ_BYTE()
-			vm.push(vm.Stack[slot])
+			slot := int(vm.READ_BYTE())
+			vm.push(vm.Stack[frame.Slots+slot])
 		case OP_SET_LOCAL:
-			slot := vm.READ_BYTE()
-			vm.Stack[slot] = vm.peek(0)
+			slot := int(vm.READ_BYTE())
+			vm.Stack[frame.Slots+slot] = vm.peek(0)
 		case OP_GET_GLOBAL:
 			nameVal := vm.READ_CONSTANT()
 			if !IsString(nameVal) {
@@ -109,14 +1123,15 @@ func (vm *VM) run() InterpretResult {
 				return INTERPRET_RUNTIME_ERROR
 			}
 			vm.push(value)
-		case OP_DEFINE_GLOBAL:
+		case OP_DEFINE_GLOBAL, OP_DEFINE_CONST:
 			nameVal := vm.READ_CONSTANT()
 			if !IsString(nameVal) {
 				vm.runtimeError("Variable name must be a string.")
 				return INTERPRET_RUNTIME_ERROR
 			}
-			name := AsString(nameVal)
-			vm.Globals[name] = vm.pop()
+			if !vm.defineGlobal(AsString(nameVal), vm.pop(), instruction == OP_DEFINE_CONST) {
+				return INTERPRET_RUNTIME_ERROR
+			}
 		case OP_SET_GLOBAL:
 			nameVal := vm.READ_CONSTANT()
 			if !IsString(nameVal) {
@@ -128,6 +1143,10 @@ func (vm *VM) run() InterpretResult {
 				vm.runtimeError("Undefined variable '%s'.", name)
 				return INTERPRET_RUNTIME_ERROR
 			}
+			if frame.Closure.Function.Module.Constants[name] {
+				vm.runtimeError("Cannot assign to constant '%s'.", name)
+				return INTERPRET_RUNTIME_ERROR
+			}
 			vm.Globals[name] = vm.peek(0)
 		case OP_EQUAL:
 			b := vm.pop()
@@ -151,9 +1170,9 @@ func (vm *VM) run() InterpretResult {
 			vm.push(BoolVal(a < b))
 		case OP_ADD:
 			if IsString(vm.peek(0)) && IsString(vm.peek(1)) {
-				b := AsString(vm.pop())
-				a := AsString(vm.pop())
-				vm.push(StringVal(a + b))
+				b := vm.pop()
+				a := vm.pop()
+				vm.push(concatenate(a, b))
 			} else if IsNumber(vm.peek(0)) && IsNumber(vm.peek(1)) {
 				b := AsNumber(vm.pop())
 				a := AsNumber(vm.pop())
@@ -186,6 +1205,48 @@ func (vm *VM) run() InterpretResult {
 			b := AsNumber(vm.pop())
 			a := AsNumber(vm.pop())
 			vm.push(NumberVal(a / b))
+		case OP_INT_DIVIDE:
+			if !IsNumber(vm.peek(0)) || !IsNumber(vm.peek(1)) {
+				vm.runtimeError("Operands must be numbers.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			b := AsNumber(vm.pop())
+			a := AsNumber(vm.pop())
+			vm.push(NumberVal(math.Floor(a / b)))
+		case OP_MODULO:
+			if !IsNumber(vm.peek(0)) || !IsNumber(vm.peek(1)) {
+				vm.runtimeError("Operands must be numbers.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			b := AsNumber(vm.pop())
+			a := AsNumber(vm.pop())
+			vm.push(NumberVal(modulo(a, b)))
+		case OP_POWER:
+			if !IsNumber(vm.peek(0)) || !IsNumber(vm.peek(1)) {
+				vm.runtimeError("Operands must be numbers.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			b := AsNumber(vm.pop())
+			a := AsNumber(vm.pop())
+			vm.push(NumberVal(math.Pow(a, b)))
+		case OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR, OP_SHIFT_LEFT, OP_SHIFT_RIGHT:
+			b := vm.pop()
+			a := vm.pop()
+			result, ok := vm.bitwise(instruction, a, b)
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(result)
+		case OP_BIT_NOT:
+			result, ok := vm.bitNot(vm.pop())
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(result)
+		case OP_TO_STRING:
+			if !IsString(vm.peek(0)) {
+				vm.push(StringVal(toString(vm.pop())))
+			}
 		case OP_NOT:
 			vm.push(BoolVal(isFalsey(vm.pop())))
 		case OP_NEGATE:
@@ -194,6 +1255,55 @@ func (vm *VM) run() InterpretResult {
 				return INTERPRET_RUNTIME_ERROR
 			}
 			vm.push(NumberVal(-AsNumber(vm.pop())))
+		case OP_BUILD_LIST:
+			count := int(vm.READ_BYTE())
+			items := append([]Value{}, vm.Stack[vm.Sp-count:vm.Sp]...)
+			vm.Sp -= count
+			vm.push(ObjVal(newList(items)))
+		case OP_BUILD_MAP:
+			count := int(vm.READ_BYTE())
+			value, ok := vm.buildMap(vm.Stack[vm.Sp-2*count : vm.Sp])
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.Sp -= 2 * count
+			vm.push(value)
+		case OP_GET_INDEX:
+			index := vm.pop()
+			value, ok := vm.getIndex(vm.pop(), index)
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(value)
+		case OP_SET_INDEX:
+			value := vm.pop()
+			index := vm.pop()
+			if !vm.setIndex(vm.pop(), index, value) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(value)
+		case OP_GET_PROPERTY:
+			value, ok := vm.getProperty(vm.peek(0), AsString(vm.READ_CONSTANT()))
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.Stack[vm.Sp-1] = value
+		case OP_INVOKE:
+			name := AsString(vm.READ_CONSTANT())
+			argCount := int(vm.READ_BYTE())
+			if handled, ok := vm.invokeFrame(name, argCount, vm.Sp-argCount-1); handled {
+				if !ok {
+					return INTERPRET_RUNTIME_ERROR
+				}
+				frame = vm.loadFrame()
+				break
+			}
+			result, ok := vm.invoke(name, vm.peek(argCount), vm.Stack[vm.Sp-argCount:vm.Sp])
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.Sp -= argCount + 1
+			vm.push(result)
 		case OP_PRINT:
 			printValues(vm.pop())
 			fmt.Printf("\n")
@@ -208,8 +1318,123 @@ func (vm *VM) run() InterpretResult {
 		case OP_LOOP:
 			offset := vm.READ_SHORT()
 			vm.Ip -= int(offset)
+			vm.tick()
+		case OP_SKIP_DEFAULT:
+			slot := int(vm.READ_BYTE())
+			offset := vm.READ_SHORT()
+			if !IsAbsent(vm.Stack[frame.Slots+slot]) {
+				vm.Ip += int(offset)
+			}
+		case OP_FOR_ITER:
+			slot := frame.Slots + int(vm.READ_BYTE())
+			offset := vm.READ_SHORT()
+			if IsObjType(vm.Stack[slot], OBJ_GENERATOR) {
+				if !vm.iterateGenerator(AsGenerator(vm.Stack[slot]), slot+2, vm.Ip+int(offset)) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+				frame = vm.loadFrame()
+				break
+			}
+			item, more, ok := vm.nextItem(vm.Stack[slot], &vm.Stack[slot+1])
+			if !ok {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(item)
+			if !more {
+				vm.Ip += int(offset)
+			}
+		case OP_GET_UPVALUE:
+			slot := vm.READ_BYTE()
+			vm.push(*frame.Closure.Upvalues[slot].Location)
+		case OP_SET_UPVALUE:
+			slot := vm.READ_BYTE()
+			*frame.Closure.Upvalues[slot].Location = vm.peek(0)
+		case OP_CALL:
+			argCount := int(vm.READ_BYTE())
+			if !vm.callValue(vm.peek(argCount), argCount, nil, vm.Sp-argCount-1) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = vm.loadFrame()
+		case OP_SPAWN:
+			argCount := int(vm.READ_BYTE())
+			if !vm.spawn(argCount, nil, vm.Sp-argCount-1) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_EXTEND:
+			spread := vm.pop()
+			if !vm.extend(vm.peek(0), spread) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_CALL_SPREAD:
+			names := AsList(vm.READ_CONSTANT()).Items
+			base := vm.Sp - len(names) - 2
+			argCount, ok := vm.spreadArguments(base, len(names))
+			if !ok || !vm.callValue(vm.Stack[base], argCount, names, base) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = vm.loadFrame()
+		case OP_CALL_NAMED:
+			argCount := int(vm.READ_BYTE())
+			names := AsList(vm.READ_CONSTANT()).Items
+			if !vm.callValue(vm.peek(argCount), argCount, names, vm.Sp-argCount-1) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = vm.loadFrame()
+		case OP_SPAWN_NAMED:
+			argCount := int(vm.READ_BYTE())
+			names := AsList(vm.READ_CONSTANT()).Items
+			if !vm.spawn(argCount, names, vm.Sp-argCount-1) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_SPAWN_SPREAD:
+			names := AsList(vm.READ_CONSTANT()).Items
+			base := vm.Sp - len(names) - 2
+			argCount, ok := vm.spreadArguments(base, len(names))
+			if !ok || !vm.spawn(argCount, names, base) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_CLOSURE:
+			function := AsFunction(vm.READ_CONSTANT())
+			closure := vm.newClosureFrom(function, frame, func() (bool, int) {
+				isLocal := vm.READ_BYTE() == 1
+				return isLocal, int(vm.READ_BYTE())
+			})
+			vm.push(ObjVal(closure))
+		case OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(vm.Sp - 1)
+			vm.pop()
+		case OP_IMPORT:
+			if !vm.importModule(AsString(vm.READ_CONSTANT()), vm.Sp) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			vm.Sp++
+			frame = vm.loadFrame()
+		case OP_THROW:
+			vm.throw(vm.pop())
+			return INTERPRET_RUNTIME_ERROR
 		case OP_RETURN:
-			return INTERPRET_OK
+			result := vm.pop()
+			vm.closeUpvalues(frame.Slots)
+			vm.FrameCount--
+			if vm.FrameCount == 0 {
+				vm.pop()
+				if !vm.finishFiber(result) {
+					return INTERPRET_OK
+				}
+				frame = vm.loadFrame()
+				break
+			}
+
+			vm.Sp = frame.Slots
+			vm.push(vm.returnValue(frame, result))
+			frame = vm.loadFrame()
+			vm.Ip = frame.Ip
+		case OP_YIELD:
+			value := vm.pop()
+			vm.yield(frame, vm.Sp-frame.Slots, value)
+			vm.Sp = frame.Slots + 1
+			frame = vm.loadFrame()
+			vm.Ip = frame.Ip
 		}
 	}
 }
@@ -228,6 +1453,75 @@ func (vm *VM) peek(distance int) Value {
 	return vm.Stack[vm.Sp-distance-1]
 }
 
+// modulo is floored: a non-zero result takes the sign of the divisor, so
+// -7 % 3 is 2 and 7 % -3 is -2. It pairs with `~/`, which floors, so that
+// a == b * (a ~/ b) + a % b.
+func modulo(a float64, b float64) float64 {
+	result := math.Mod(a, b)
+	if result != 0 && (result < 0) != (b < 0) {
+		result += b
+	}
+	return result
+}
+
+// asInteger reports the integer a number holds, if it holds one that
+// fits in 64 bits. Bitwise operators only accept such numbers.
+func asInteger(value float64) (int64, bool) {
+	if value != math.Trunc(value) || value < math.MinInt64 || value >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+// bitwise applies one of the binary bitwise opcodes to two integers. `>>`
+// is arithmetic, so it keeps the sign of a negative left operand.
+func (vm *VM) bitwise(op uint8, a Value, b Value) (Value, bool) {
+	if !IsNumber(a) || !IsNumber(b) {
+		vm.runtimeError("Operands must be numbers.")
+		return NilVal(), false
+	}
+	x, xok := asInteger(AsNumber(a))
+	y, yok := asInteger(AsNumber(b))
+	if !xok || !yok {
+		vm.runtimeError("Operands must be integers.")
+		return NilVal(), false
+	}
+
+	var result int64
+	switch op {
+	case OP_BIT_AND:
+		result = x & y
+	case OP_BIT_OR:
+		result = x | y
+	case OP_BIT_XOR:
+		result = x ^ y
+	case OP_SHIFT_LEFT, OP_SHIFT_RIGHT:
+		if y < 0 {
+			vm.runtimeError("Shift count must not be negative.")
+			return NilVal(), false
+		}
+		if op == OP_SHIFT_LEFT {
+			result = x << uint64(y)
+		} else {
+			result = x >> uint64(y)
+		}
+	}
+	return NumberVal(float64(result)), true
+}
+
+func (vm *VM) bitNot(value Value) (Value, bool) {
+	if !IsNumber(value) {
+		vm.runtimeError("Operand must be a number.")
+		return NilVal(), false
+	}
+	x, ok := asInteger(AsNumber(value))
+	if !ok {
+		vm.runtimeError("Operand must be an integer.")
+		return NilVal(), false
+	}
+	return NumberVal(float64(^x)), true
+}
+
 func isFalsey(value Value) bool {
 	return IsNil(value) || (IsBool(value) && !AsBool(value))
 }